@@ -1,22 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"http-server/internal/compress"
 	"http-server/internal/headers"
 	"http-server/internal/request"
 	"http-server/internal/response"
+	"http-server/internal/router"
 	"http-server/internal/server"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
+const shutdownTimeout = 30 * time.Second
 
 func main() {
 	// server, err := basicServer()
@@ -25,44 +29,68 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error draining connections: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
 
 func basicServer() (*server.Server, error) {
-	return server.Serve(port, func(w *response.Writer, req *request.Request) {
-		var msg []byte
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			msg = respone400()
-		case "/myproblem":
-			msg = respone500()
-		default:
-			msg = respone200()
-		}
+	routes := router.New()
 
-		w.WriteStatusLine(response.StatusBadRequest)
-		heads := response.GetDefaultHeaders(len(msg))
-		heads.Replace("Content-Type", "text/html")
-		w.WriteHeaders(heads)
-		w.WriteBody(msg)
-	})
+	routes.Get("/yourproblem", htmlHandler(response.StatusBadRequest, respone400()))
+	routes.Get("/myproblem", htmlHandler(response.StatusInternalServerError, respone500()))
+	routes.Get("/*path", htmlHandler(response.StatusOk, respone200()))
+
+	return server.Serve(port, routes.Handler(), server.WithMiddleware(logRequests))
+}
+
+func logRequests(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		next(w, req)
+		log.Printf("%s %s %d %dB %s", req.RequestLine.Method, req.RequestLine.RequestTarget, w.StatusCode(), w.BytesWritten(), time.Since(start))
+	}
+}
+
+func htmlHandler(status response.StatusCode, msg []byte) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(status)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(msg)
+	}
 }
 
 func proxyServer() (*server.Server, error) {
-	return server.Serve(port, func(w *response.Writer, req *request.Request) {
-		route := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-		if route == req.RequestLine.RequestTarget {
-			log.Print("request isn't to httpbin servers")
+	routes := router.New()
+
+	routes.Get("/httpbin/*route", func(w *response.Writer, req *request.Request) {
+		// forwarded still encoded, a decoded %3F would start a query upstream
+		route := req.RawParam("route")
+
+		if req.Target.RawQuery != "" {
+			route += "?" + req.Target.RawQuery
+		}
+
+		// the upstream fetch is dropped as soon as the client goes away
+		upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, "https://httpbin.org/"+route, nil)
+
+		if err != nil {
+			log.Print("something went wrong while building the request", err)
 			return
 		}
 
-		res, err := http.Get("https://httpbin.org/" + route)
+		res, err := http.DefaultClient.Do(upstreamReq)
 
 		if err != nil {
 			log.Print("something went wrong while getting data", err)
@@ -86,6 +114,7 @@ func proxyServer() (*server.Server, error) {
 
 			if n > 0 {
 				w.WriteChunkedBody(buf[:n])
+				w.Flush()
 				fullBody = append(fullBody, buf[:n]...)
 			}
 
@@ -106,6 +135,8 @@ func proxyServer() (*server.Server, error) {
 		trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
 		w.WriteTrailers(trailers)
 	})
+
+	return server.Serve(port, routes.Handler(), server.WithMiddleware(logRequests, compress.Middleware()))
 }
 
 func respone200() []byte {
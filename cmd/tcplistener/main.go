@@ -44,8 +44,14 @@ func main() {
 			fmt.Printf("- %s: %s\n", key, value)
 		})
 
+		body, err := reqeust.ReadBody()
+
+		if err != nil {
+			log.Fatal("failed to read body", err)
+		}
+
 		fmt.Println("Body:")
-		fmt.Println(string(reqeust.Body))
+		fmt.Println(string(body))
 	}
 
 }
@@ -0,0 +1,177 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"http-server/internal/headers"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMinSize is the smallest body worth compressing, the coding's own
+// framing outweighs what is saved below it
+const DefaultMinSize = 1024
+
+// codings are the content codings the middleware can send, in the order it
+// prefers them when the client weighs them the same
+var codings = []struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}{
+	{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }},
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+	// deflate is a zlib stream, not a raw deflate one, despite its name
+	{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+}
+
+// compressedTypes are media types whose content is compressed already,
+// compressing them again costs time and saves nothing
+var compressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/vnd.rar",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+}
+
+type config struct {
+	minSize int
+}
+
+type Option func(*config)
+
+// WithMinSize sets the smallest body compressed when its length is known
+// before it is written, DefaultMinSize otherwise
+func WithMinSize(size int) Option {
+	return func(c *config) {
+		c.minSize = size
+	}
+}
+
+// Middleware compresses responses with the coding the client prefers in its
+// Accept-Encoding field among br, gzip and deflate. Responses the handler
+// encoded itself, small ones and those of a type that is compressed already
+// are sent as they are
+func Middleware(opts ...Option) server.Middleware {
+	c := config{minSize: DefaultMinSize}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.SetEncoder(c.encoder(&req.Headers))
+			next(w, req)
+		}
+	}
+}
+
+func (c config) encoder(reqHeaders *headers.Headers) *response.ContentEncoder {
+	coding, newWriter := Negotiate(reqHeaders)
+
+	return &response.ContentEncoder{
+		Coding:    coding,
+		NewWriter: newWriter,
+		Accept: func(heads *headers.Headers, length int) bool {
+			if !isCompressible(heads) {
+				return false
+			}
+
+			// caches have to know another client may get another coding
+			if !heads.HasToken("vary", "accept-encoding") && !heads.HasToken("vary", "*") {
+				heads.Add("Vary", "Accept-Encoding")
+			}
+
+			if coding == "" || heads.HasToken("cache-control", "no-transform") {
+				return false
+			}
+
+			return length < 0 || length >= c.minSize
+		},
+	}
+}
+
+// Negotiate picks the coding to send a response in given the request's
+// Accept-Encoding field, "" if none is acceptable or the field is missing
+func Negotiate(reqHeaders *headers.Headers) (string, func(io.Writer) io.WriteCloser) {
+	weights := map[string]float64{}
+	wildcard := 0.0
+
+	for _, value := range reqHeaders.GetQualityValues("accept-encoding") {
+		coding := strings.ToLower(value.Value)
+
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+
+		if _, exists := weights[coding]; exists {
+			continue
+		}
+
+		if coding == "*" {
+			wildcard = value.Q
+		}
+
+		weights[coding] = value.Q
+	}
+
+	best := -1
+	bestQ := 0.0
+
+	for i, coding := range codings {
+		q, exists := weights[coding.name]
+
+		if !exists {
+			q = wildcard
+		}
+
+		if q > bestQ {
+			best = i
+			bestQ = q
+		}
+	}
+
+	if best == -1 {
+		return "", nil
+	}
+
+	return codings[best].name, codings[best].newWriter
+}
+
+// isCompressible reports whether the body may be compressed, partial content
+// never is since its ranges refer to the body as it is
+func isCompressible(heads *headers.Headers) bool {
+	contentType, _ := heads.Get("content-type")
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.Trim(mediaType, " \t"))
+
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, compressed := range compressedTypes {
+		if strings.HasSuffix(compressed, "/") && strings.HasPrefix(mediaType, compressed) || mediaType == compressed {
+			return false
+		}
+	}
+
+	_, ranged := heads.Get("content-range")
+
+	return !ranged
+}
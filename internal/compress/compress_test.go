@@ -0,0 +1,350 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"http-server/internal/servertest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs h behind the middleware for a request with the given
+// Accept-Encoding and returns the parsed response and its raw body
+func serve(t *testing.T, h server.Handler, acceptEncoding string, opts ...Option) (*http.Response, []byte) {
+	return serveMethod(t, "GET", h, acceptEncoding, opts...)
+}
+
+func serveMethod(t *testing.T, method string, h server.Handler, acceptEncoding string, opts ...Option) (*http.Response, []byte) {
+	fields := []string{}
+
+	if acceptEncoding != "" {
+		fields = append(fields, "Accept-Encoding: "+acceptEncoding)
+	}
+
+	res, body := servertest.Serve(t, Middleware(opts...)(h), method, "/", fields...)
+
+	return res, []byte(body)
+}
+
+func decode(t *testing.T, coding string, body []byte) string {
+	var reader io.Reader
+
+	switch coding {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		reader = gzipReader
+	case "deflate":
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		reader = zlibReader
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	return string(decoded)
+}
+
+var text = strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+
+func writeText(w *response.Writer, req *request.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, text)
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                          "",
+		"gzip":                      "gzip",
+		"x-gzip":                    "gzip",
+		"deflate, gzip":             "gzip",
+		"gzip, deflate, br":         "br",
+		"br;q=0.5, gzip":            "gzip",
+		"br;q=0, gzip;q=0.1":        "gzip",
+		"*":                         "br",
+		"*, br;q=0":                 "gzip",
+		"identity":                  "",
+		"gzip;q=0, deflate;q=0":     "",
+		"compress, zstd":            "",
+		"GZIP;Q=0.8, Deflate;q=0.9": "deflate",
+	}
+
+	for acceptEncoding, expected := range cases {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: " + acceptEncoding + "\r\n\r\n"))
+		require.NoError(t, err)
+
+		coding, newWriter := Negotiate(&req.Headers)
+		assert.Equal(t, expected, coding, acceptEncoding)
+		assert.Equal(t, expected != "", newWriter != nil, acceptEncoding)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: Buffered body is compressed with a Content-Length of the result
+	for _, coding := range []string{"gzip", "deflate", "br"} {
+		res, body := serve(t, writeText, coding)
+		assert.Equal(t, coding, res.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+		assert.Equal(t, int64(len(body)), res.ContentLength)
+		assert.Less(t, len(body), len(text))
+		assert.Equal(t, text, decode(t, coding, body))
+	}
+
+	// Test: Client without Accept-Encoding gets the body as is, still with Vary
+	res, body := serve(t, writeText, "")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	assert.Equal(t, text, string(body))
+
+	// Test: Small bodies aren't worth compressing
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "short")
+	}, "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(5), res.ContentLength)
+	assert.Equal(t, "short", string(body))
+
+	res, _ = serve(t, writeText, "gzip", WithMinSize(len(text)+1))
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+
+	// Test: Content types that are compressed already are left alone
+	for _, contentType := range []string{"image/png", "video/mp4", "application/zip", "application/gzip", "font/woff2"} {
+		res, body = serve(t, func(w *response.Writer, req *request.Request) {
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, text)
+		}, "gzip")
+		assert.Empty(t, res.Header.Get("Content-Encoding"), contentType)
+		assert.Empty(t, res.Header.Get("Vary"), contentType)
+		assert.Equal(t, text, string(body), contentType)
+	}
+
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, text)
+	}, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, text, decode(t, "gzip", body))
+
+	// Test: A body the handler encoded itself isn't encoded again
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Encoding", "identity")
+		io.WriteString(w, text)
+	}, "gzip")
+	assert.Equal(t, "identity", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, text, string(body))
+
+	// Test: no-transform forbids changing the coding
+	res, _ = serve(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Cache-Control", "no-transform")
+		io.WriteString(w, text)
+	}, "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+
+	// Test: HEAD responses get the headers of the GET one, without the body
+	get, getBody := serve(t, writeText, "gzip")
+	res, body = serveMethod(t, "HEAD", writeText, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, get.Header.Get("Vary"), res.Header.Get("Vary"))
+	assert.Equal(t, int64(len(getBody)), res.ContentLength)
+	assert.Empty(t, body)
+
+	res, body = serveMethod(t, "HEAD", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(len(text)))
+	}, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Empty(t, body)
+}
+
+func TestMiddlewareFraming(t *testing.T) {
+	// Test: Fixed length body written with WriteHeaders switches to chunked
+	res, body := serve(t, func(w *response.Writer, req *request.Request) {
+		require.NoError(t, w.WriteStatusLine(response.StatusOk))
+		require.NoError(t, w.WriteHeaders(response.GetDefaultHeaders(len(text))))
+		_, err := w.WriteBody([]byte(text))
+		require.NoError(t, err)
+	}, "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, int64(-1), res.ContentLength)
+	assert.Equal(t, text, decode(t, "gzip", body))
+
+	// Test: Fixed length body below the minimum size keeps its length
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("short"))
+	}, "gzip")
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(5), res.ContentLength)
+	assert.Equal(t, "short", string(body))
+
+	// Test: Chunked body with trailers is compressed chunk by chunk
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		heads := response.GetDefaultHeaders(0)
+		heads.Delete("Content-Length")
+		heads.Set("Transfer-Encoding", "chunked")
+		heads.Set("Trailer", "X-Done")
+		w.WriteStatusLine(response.StatusOk)
+		require.NoError(t, w.WriteHeaders(heads))
+
+		for _, line := range strings.SplitAfter(text, "\n") {
+			_, err := w.WriteChunkedBody([]byte(line))
+			require.NoError(t, err)
+		}
+
+		_, err := w.WriteChunkedBodyDone(true)
+		require.NoError(t, err)
+
+		trailers := response.GetDefaultHeaders(0)
+		trailers.Delete("Content-Length")
+		trailers.Delete("Content-Type")
+		trailers.Set("X-Done", "yes")
+		require.NoError(t, w.WriteTrailers(trailers))
+	}, "br")
+	assert.Equal(t, "br", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, text, decode(t, "br", body))
+	assert.Equal(t, "yes", res.Trailer.Get("X-Done"))
+
+	// Test: Bodies too large to buffer are streamed compressed
+	large := strings.Repeat(text, 10)
+	res, body = serve(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, large)
+		require.NoError(t, w.Flush())
+		io.WriteString(w, large)
+	}, "deflate")
+	assert.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, large+large, decode(t, "deflate", body))
+}
+
+// decodeRequest runs h behind DecodeRequests for a POST with the given
+// Content-Encoding and body
+func decodeRequest(t *testing.T, h server.Handler, contentEncoding string, body []byte, opts ...DecodeOption) *http.Response {
+	raw := fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n", contentEncoding, len(body))
+	req, err := request.RequestFromReader(io.MultiReader(strings.NewReader(raw), bytes.NewReader(body)))
+	require.NoError(t, err)
+
+	output := &bytes.Buffer{}
+	w := response.NewWriter(output)
+	DecodeRequests(opts...)(h)(w, req)
+	require.NoError(t, w.Finish())
+
+	res, err := http.ReadResponse(bufio.NewReader(output), nil)
+	require.NoError(t, err)
+
+	return res
+}
+
+func encode(t *testing.T, coding string, body string) []byte {
+	encoded := &bytes.Buffer{}
+	var compressor io.WriteCloser
+
+	switch coding {
+	case "gzip":
+		compressor = gzip.NewWriter(encoded)
+	case "deflate":
+		compressor = zlib.NewWriter(encoded)
+	case "br":
+		compressor = brotli.NewWriter(encoded)
+	}
+
+	_, err := io.WriteString(compressor, body)
+	require.NoError(t, err)
+	require.NoError(t, compressor.Close())
+
+	return encoded.Bytes()
+}
+
+func TestDecodeRequests(t *testing.T) {
+	var received string
+	var readErr error
+	var heads []string
+	echo := func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		received, readErr = string(body), err
+		_, hasEncoding := req.Headers.Get("Content-Encoding")
+		_, hasLength := req.Headers.Get("Content-Length")
+		heads = []string{fmt.Sprint(hasEncoding), fmt.Sprint(hasLength)}
+		io.WriteString(w, "ok")
+	}
+
+	// Test: Encoded bodies are read decoded, without the fields describing
+	// the encoded one
+	for _, coding := range []string{"gzip", "deflate", "br"} {
+		res := decodeRequest(t, echo, coding, encode(t, coding, text))
+		assert.Equal(t, 200, res.StatusCode)
+		require.NoError(t, readErr, coding)
+		assert.Equal(t, text, received, coding)
+		assert.Equal(t, []string{"false", "false"}, heads, coding)
+	}
+
+	// Test: Codings applied one after the other are undone in reverse
+	twice := encode(t, "gzip", string(encode(t, "deflate", text)))
+	decodeRequest(t, echo, "deflate, GZIP", twice)
+	require.NoError(t, readErr)
+	assert.Equal(t, text, received)
+
+	// Test: identity bodies are left as they are
+	decodeRequest(t, echo, "identity", []byte(text))
+	require.NoError(t, readErr)
+	assert.Equal(t, text, received)
+	assert.Equal(t, []string{"true", "true"}, heads)
+
+	// Test: Unknown codings get 415 without running the handler
+	received = ""
+	res := decodeRequest(t, echo, "compress", []byte(text))
+	assert.Equal(t, 415, res.StatusCode)
+	assert.Equal(t, "gzip, deflate, br", res.Header.Get("Accept-Encoding"))
+	assert.Empty(t, received)
+
+	res = decodeRequest(t, echo, "gzip, zstd", []byte(text))
+	assert.Equal(t, 415, res.StatusCode)
+
+	// Test: Decoding stops at the size limit
+	bomb := encode(t, "gzip", strings.Repeat("0", 1024*1024))
+	assert.Less(t, len(bomb), 10*1024)
+	decodeRequest(t, echo, "gzip", bomb, WithMaxDecodedSize(1000))
+	assert.ErrorIs(t, readErr, request.ErrorBodyTooLarge)
+	assert.Len(t, received, 1000)
+
+	// Test: Close reports the error so the server can answer with it
+	var closeErr error
+	decodeRequest(t, func(w *response.Writer, req *request.Request) {
+		req.ReadBody()
+		closeErr = req.Body.Close()
+		io.WriteString(w, "ok")
+	}, "gzip", bomb, WithMaxDecodedSize(1000))
+	assert.ErrorIs(t, closeErr, request.ErrorBodyTooLarge)
+
+	decodeRequest(t, echo, "gzip", bomb, WithMaxDecodedSize(0))
+	require.NoError(t, readErr)
+	assert.Len(t, received, 1024*1024)
+
+	// Test: Bodies that aren't in the coding they claim fail to read
+	decodeRequest(t, echo, "gzip", []byte(text))
+	assert.ErrorIs(t, readErr, ErrorMalformedBody)
+
+	truncated := encode(t, "gzip", text)
+	decodeRequest(t, echo, "gzip", truncated[:len(truncated)/2])
+	assert.ErrorIs(t, readErr, ErrorMalformedBody)
+}
@@ -0,0 +1,188 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMaxDecodedSize bounds decoded request bodies, a few kilobytes of
+// gzip can otherwise expand to gigabytes
+const DefaultMaxDecodedSize = 10 * 1024 * 1024
+
+var ErrorMalformedBody = errors.New("body doesn't match its content encoding")
+
+// decoders are the content codings request bodies can be sent in
+var decoders = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"x-gzip":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	"br":      func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+}
+
+type decodeConfig struct {
+	maxDecodedSize int64
+}
+
+type DecodeOption func(*decodeConfig)
+
+// WithMaxDecodedSize caps how big a body can get once decoded, zero means no
+// limit. DefaultMaxDecodedSize otherwise
+func WithMaxDecodedSize(size int64) DecodeOption {
+	return func(c *decodeConfig) {
+		c.maxDecodedSize = size
+	}
+}
+
+// DecodeRequests makes the handler read request bodies sent with a gzip,
+// deflate or br Content-Encoding decoded. Content-Encoding and Content-Length
+// are removed since they no longer describe Body. Bodies in other codings are
+// answered with 415, reading past the size limit fails with
+// request.ErrorBodyTooLarge
+func DecodeRequests(opts ...DecodeOption) server.Middleware {
+	c := decodeConfig{maxDecodedSize: DefaultMaxDecodedSize}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			codings := []string{}
+
+			for _, coding := range req.Headers.GetList("content-encoding") {
+				if !strings.EqualFold(coding, "identity") {
+					codings = append(codings, strings.ToLower(coding))
+				}
+			}
+
+			for _, coding := range codings {
+				if _, exists := decoders[coding]; !exists {
+					// the codings that would have been accepted
+					server.MakeStatusError(response.StatusUnsupportedMediaType).WithHeader("Accept-Encoding", "gzip, deflate, br").Write(w)
+					return
+				}
+			}
+
+			if len(codings) > 0 {
+				req.Body = &decodingBody{
+					raw:     &recordingReader{reader: req.Body},
+					closer:  req.Body,
+					codings: codings,
+					limit:   c.maxDecodedSize,
+				}
+				req.Headers.Delete("Content-Encoding")
+				req.Headers.Delete("Content-Length")
+			}
+
+			next(w, req)
+		}
+	}
+}
+
+// decodingBody decodes a body the first time it's read so the middleware
+// doesn't wait on the client for the coding's header
+type decodingBody struct {
+	raw     *recordingReader
+	closer  io.Closer
+	codings []string
+	decoded io.Reader
+	limit   int64
+	read    int64
+	err     error
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if d.decoded == nil {
+		if err := d.start(); err != nil {
+			d.err = d.wrap(err)
+			return 0, d.err
+		}
+	}
+
+	n, err := d.decoded.Read(p)
+	d.read += int64(n)
+
+	if d.limit > 0 && d.read > d.limit {
+		d.err = fmt.Errorf("%w: decoded body is over %d bytes", request.ErrorBodyTooLarge, d.limit)
+		return n - int(d.read-d.limit), d.err
+	}
+
+	if err != nil {
+		d.err = d.wrap(err)
+	}
+
+	return n, d.err
+}
+
+// start stacks the decoders, the last coding applied being the first undone
+func (d *decodingBody) start() error {
+	var reader io.Reader = d.raw
+
+	for i := len(d.codings) - 1; i >= 0; i-- {
+		decoder, err := decoders[d.codings[i]](reader)
+
+		if err != nil {
+			return err
+		}
+
+		reader = decoder
+	}
+
+	d.decoded = reader
+
+	return nil
+}
+
+// wrap tells the errors of the connection, which are returned as they are,
+// from those of a body that can't be decoded
+func (d *decodingBody) wrap(err error) error {
+	if err == io.EOF || (d.raw.err != nil && d.raw.err != io.EOF && errors.Is(err, d.raw.err)) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrorMalformedBody, err)
+}
+
+// Close closes the body underneath, which discards what wasn't decoded. Like
+// it, Close returns the error that stopped the reads, for the server to
+// answer with if the handler didn't
+func (d *decodingBody) Close() error {
+	if err := d.closer.Close(); err != nil {
+		return err
+	}
+
+	if d.err != nil && d.err != io.EOF {
+		return d.err
+	}
+
+	return nil
+}
+
+// recordingReader keeps the last error reading the body returned
+type recordingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	if err != nil {
+		r.err = err
+	}
+
+	return n, err
+}
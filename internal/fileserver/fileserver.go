@@ -0,0 +1,275 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"http-server/internal/headers"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sniffLength is how much of a file content sniffing looks at
+const sniffLength = 512
+
+const indexFile = "index.html"
+
+var ErrorNotDirectory = errors.New("root isn't a directory")
+
+type FileServer struct {
+	root            *os.Root
+	prefix          string
+	listDirectories bool
+}
+
+type Option func(*FileServer)
+
+// WithPrefix serves the path after prefix, for a file server mounted under
+// /static for instance. Paths without it get 404
+func WithPrefix(prefix string) Option {
+	return func(f *FileServer) {
+		f.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithDirectoryListing lists the entries of directories without an
+// index.html instead of answering 404
+func WithDirectoryListing() Option {
+	return func(f *FileServer) {
+		f.listDirectories = true
+	}
+}
+
+// New serves the files under dir. Paths are resolved inside dir only, ".."
+// and symbolic links can't lead out of it
+func New(dir string, opts ...Option) (*FileServer, error) {
+	info, err := os.Stat(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrorNotDirectory, dir)
+	}
+
+	root, err := os.OpenRoot(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileServer{root: root}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f, nil
+}
+
+// Handler returns the handler serving the files, pass it to the router or
+// server.Serve
+func (f *FileServer) Handler() server.Handler {
+	return f.serve
+}
+
+// Close releases the directory, the handler answers 404 afterwards
+func (f *FileServer) Close() error {
+	return f.root.Close()
+}
+
+func (f *FileServer) serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+
+	if method != "GET" && method != "HEAD" {
+		server.MakeStatusError(response.StatusMethodNotAllowed).WithHeader("Allow", "GET, HEAD").Write(w)
+		return
+	}
+
+	name, ok := f.name(req.Target.Path)
+
+	if !ok {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	file, err := f.root.Open(name)
+
+	if err != nil {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	if info.IsDir() {
+		f.serveDirectory(w, req, name, file)
+		return
+	}
+
+	// devices, sockets and pipes aren't files to download, and a file isn't
+	// a directory
+	if !info.Mode().IsRegular() || strings.HasSuffix(req.Target.Path, "/") {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	serveFile(w, req, file, info)
+}
+
+// name turns a request path into a name inside the root, "." being the root
+func (f *FileServer) name(requestPath string) (string, bool) {
+	if f.prefix != "" {
+		rest, found := strings.CutPrefix(requestPath, f.prefix)
+
+		if !found || (rest != "" && rest[0] != '/') {
+			return "", false
+		}
+
+		requestPath = rest
+	}
+
+	name := strings.Trim(requestPath, "/")
+
+	if name == "" {
+		return ".", true
+	}
+
+	return name, true
+}
+
+// serveDirectory redirects to the path with a trailing slash so relative links
+// resolve inside the directory, then serves its index.html or lists it
+func (f *FileServer) serveDirectory(w *response.Writer, req *request.Request, name string, dir *os.File) {
+	if !strings.HasSuffix(req.Target.Path, "/") {
+		// built from the encoded path so what was escaped stays escaped, with
+		// a single leading slash since "//docs" would name the host docs
+		location := "/" + strings.TrimLeft(strings.Join(req.Target.RawSegments(), "/"), "/") + "/"
+
+		if req.Target.RawQuery != "" {
+			location += "?" + req.Target.RawQuery
+		}
+
+		server.MakeStatusError(response.StatusMovedPermanently).WithHeader("Location", location).Write(w)
+		return
+	}
+
+	index, err := f.root.Open(path.Join(name, indexFile))
+
+	if err == nil {
+		defer index.Close()
+
+		if info, err := index.Stat(); err == nil && info.Mode().IsRegular() {
+			serveFile(w, req, index, info)
+			return
+		}
+	}
+
+	if !f.listDirectories {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	entries, err := dir.ReadDir(-1)
+
+	if err != nil {
+		server.MakeStatusError(response.StatusInternalServerError).Write(w)
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		entryName := entry.Name()
+
+		if entry.IsDir() {
+			entryName += "/"
+		}
+
+		names = append(names, entryName)
+	}
+
+	slices.Sort(names)
+
+	title := html.EscapeString(req.Target.Path)
+	body := &strings.Builder{}
+	fmt.Fprintf(body, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+
+	for _, entryName := range names {
+		// "./" keeps a name with a colon from being read as a URL scheme
+		href := "./" + (&url.URL{Path: entryName}).EscapedPath()
+		fmt.Fprintf(body, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+
+	body.WriteString("</ul>\n</body>\n</html>\n")
+
+	heads := response.GetDefaultHeaders(body.Len())
+	heads.Replace("Content-Type", "text/html; charset=utf-8")
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(heads)
+	w.WriteBody([]byte(body.String()))
+}
+
+// serveFile sends a file with its type, length and modification date
+func serveFile(w *response.Writer, req *request.Request, file *os.File, info os.FileInfo) {
+	contentType, err := detectContentType(file, info.Name())
+
+	if err != nil {
+		server.MakeStatusError(response.StatusInternalServerError).Write(w)
+		return
+	}
+
+	heads := headers.NewHeaders()
+	heads.Set("Content-Type", contentType)
+	heads.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	heads.Set("Last-Modified", headers.FormatTime(info.ModTime()))
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(heads)
+
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	io.CopyN(w, file, info.Size())
+}
+
+// detectContentType goes by the file's extension, then by its first bytes
+// when the extension is unknown
+func detectContentType(file *os.File, name string) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	buf := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, buf)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
@@ -0,0 +1,186 @@
+package fileserver
+
+import (
+	"http-server/internal/headers"
+	"http-server/internal/servertest"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTree writes files, named by their slash separated path, under a
+// temporary directory
+func newTree(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	return dir
+}
+
+// get sends a request for target to f and returns the response and its body
+func get(t *testing.T, f *FileServer, method string, target string) (*http.Response, string) {
+	return servertest.Serve(t, f.Handler(), method, target)
+}
+
+func TestFileServer(t *testing.T) {
+	dir := newTree(t, map[string]string{
+		"style.css":       "body {}",
+		"data":            "%PDF-1.4 not really",
+		"notes":           "plain words",
+		"docs/index.html": "<h1>docs</h1>",
+		"site/a.txt":      "a",
+		"what?/x":         "x",
+		"100%/x":          "x",
+		"a b/x":           "x",
+	})
+	modTime := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "style.css"), modTime, modTime))
+
+	f, err := New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	// Test: File is sent with its type, length and modification date
+	res, body := get(t, f, "GET", "/style.css")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "body {}", body)
+	assert.Equal(t, "text/css; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, int64(7), res.ContentLength)
+	assert.Equal(t, headers.FormatTime(modTime), res.Header.Get("Last-Modified"))
+
+	// Test: Content is sniffed when the extension says nothing
+	res, body = get(t, f, "GET", "/data")
+	assert.Equal(t, "application/pdf", res.Header.Get("Content-Type"))
+	assert.Equal(t, "%PDF-1.4 not really", body)
+
+	res, _ = get(t, f, "GET", "/notes")
+	assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: HEAD gets the headers of GET without the body
+	res, body = get(t, f, "HEAD", "/style.css")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "7", res.Header.Get("Content-Length"))
+	assert.Equal(t, headers.FormatTime(modTime), res.Header.Get("Last-Modified"))
+	assert.Empty(t, body)
+
+	// Test: Other methods aren't allowed
+	res, _ = get(t, f, "POST", "/style.css")
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Header.Get("Allow"))
+
+	// Test: Directory is redirected to its slash form, then its index served
+	res, _ = get(t, f, "GET", "/docs?lang=en")
+	assert.Equal(t, 301, res.StatusCode)
+	assert.Equal(t, "/docs/?lang=en", res.Header.Get("Location"))
+
+	// Test: Redirect keeps the path encoded and can't point at another host
+	redirects := map[string]string{
+		"//docs":      "/docs/",
+		"///docs":     "/docs/",
+		"/what%3F":    "/what%3F/",
+		"/100%25":     "/100%25/",
+		"/a%20b":      "/a%20b/",
+		"/x/../a%20b": "/a%20b/",
+	}
+
+	for target, location := range redirects {
+		res, _ = get(t, f, "GET", target)
+		assert.Equal(t, 301, res.StatusCode, target)
+		assert.Equal(t, location, res.Header.Get("Location"), target)
+	}
+
+	res, body = get(t, f, "GET", "/docs/")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "<h1>docs</h1>", body)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+	// Test: Directories aren't listed unless asked
+	res, _ = get(t, f, "GET", "/site/")
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Test: Missing files and paths leading out of the root get 404
+	for _, target := range []string{"/missing.txt", "/../" + filepath.Base(dir) + "/style.css", "/%2e%2e/etc/passwd", "/style.css/"} {
+		res, _ = get(t, f, "GET", target)
+		assert.Equal(t, 404, res.StatusCode, target)
+	}
+}
+
+func TestFileServerSymlinks(t *testing.T) {
+	outside := newTree(t, map[string]string{"secret.txt": "secret"})
+	dir := newTree(t, map[string]string{"public.txt": "public"})
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "link.txt")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "outside")))
+
+	f, err := New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	// Test: Symbolic links can't lead out of the root
+	for _, target := range []string{"/link.txt", "/outside/secret.txt"} {
+		res, body := get(t, f, "GET", target)
+		assert.Equal(t, 404, res.StatusCode, target)
+		assert.NotContains(t, body, "secret", target)
+	}
+
+	res, body := get(t, f, "GET", "/public.txt")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "public", body)
+}
+
+func TestFileServerOptions(t *testing.T) {
+	dir := newTree(t, map[string]string{
+		"index.html":       "home",
+		"site/a b.txt":     "spaced",
+		"site/sub/c.txt":   "c",
+		"site/<script>.js": "x",
+	})
+
+	f, err := New(dir, WithPrefix("/static/"), WithDirectoryListing())
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	// Test: Paths are served relative to the prefix
+	res, body := get(t, f, "GET", "/static/")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "home", body)
+
+	res, body = get(t, f, "GET", "/static/site/a%20b.txt")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "spaced", body)
+
+	for _, target := range []string{"/index.html", "/staticfile", "/other/index.html"} {
+		res, _ = get(t, f, "GET", target)
+		assert.Equal(t, 404, res.StatusCode, target)
+	}
+
+	// Test: Directory without an index is listed, names escaped
+	res, body = get(t, f, "GET", "/static/site/")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<a href="./%3Cscript%3E.js">&lt;script&gt;.js</a>`)
+	assert.Contains(t, body, `<a href="./a%20b.txt">a b.txt</a>`)
+	assert.Contains(t, body, `<a href="./sub/">sub/</a>`)
+	assert.Less(t, strings.Index(body, "&lt;script&gt;.js"), strings.Index(body, "a b.txt"))
+}
+
+func TestNew(t *testing.T) {
+	dir := newTree(t, map[string]string{"file.txt": "x"})
+
+	// Test: Root has to be an existing directory
+	_, err := New(filepath.Join(dir, "file.txt"))
+	assert.ErrorIs(t, err, ErrorNotDirectory)
+
+	_, err = New(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -5,37 +5,81 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 )
 
+// field holds every value sent for one field name, in the order they came.
+// name is the spelling the field was set with, order is when it was first
+// added, it keeps iteration stable
+type field struct {
+	name   string
+	values []string
+	order  int
+}
+
 type Headers struct {
-	headers map[string]string
+	headers  map[string]*field
+	added    int
+	maxBytes int
+	maxCount int
+	size     int
+	count    int
 }
 
 func NewHeaders() Headers {
 	return Headers{
-		headers: make(map[string]string),
+		headers: make(map[string]*field),
 	}
 }
 
 const SEPARATOR = "\r\n"
 
 var (
-	ErrorInvalidFieldLine = errors.New("invalid field line")
-	ErrorInvalidFieldName = errors.New("invalid field name")
+	ErrorInvalidFieldLine  = errors.New("invalid field line")
+	ErrorInvalidFieldName  = errors.New("invalid field name")
+	ErrorInvalidFieldValue = errors.New("invalid field value")
+	ErrorHeadersTooLarge   = errors.New("header section is too large")
+	ErrorTooManyHeaders    = errors.New("too many header fields")
+	ErrorBareLineBreak     = errors.New("line break isn't CRLF")
 )
 
+// SetLimits caps the total size of the field lines Parse accepts and how many
+// there can be, zero means no limit
+func (h *Headers) SetLimits(maxBytes int, maxCount int) {
+	h.maxBytes = maxBytes
+	h.maxCount = maxCount
+}
+
 func (h *Headers) Parse(data []byte) (int, bool, error) {
 	readBytes := 0
 	done := false
 
 	for {
 		separatorIndex := bytes.Index(data[readBytes:], []byte(SEPARATOR))
+		lineFeedIndex := bytes.IndexByte(data[readBytes:], '\n')
+
+		// a lone CR or LF may end the line for another parser on the way,
+		// which would then see different headers than we do
+		if lineFeedIndex != -1 && (separatorIndex == -1 || lineFeedIndex != separatorIndex+1) {
+			return 0, false, ErrorBareLineBreak
+		}
 
 		if separatorIndex == -1 {
+			// the line being received can't fit anymore
+			if h.maxBytes > 0 && h.size+len(data)-readBytes > h.maxBytes {
+				return 0, false, ErrorHeadersTooLarge
+			}
+
 			return readBytes, false, nil
 		}
 
+		h.size += separatorIndex + len(SEPARATOR)
+
+		if h.maxBytes > 0 && h.size > h.maxBytes {
+			return 0, false, ErrorHeadersTooLarge
+		}
+
 		// empty header
 		if separatorIndex == 0 {
 			done = true
@@ -43,41 +87,137 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 			break
 		}
 
-		fieldName, fieldValue, err := parseHeader(data[readBytes : readBytes+separatorIndex])
+		h.count++
+
+		if h.maxCount > 0 && h.count > h.maxCount {
+			return 0, false, ErrorTooManyHeaders
+		}
+
+		fieldLine := data[readBytes : readBytes+separatorIndex]
+
+		if bytes.IndexByte(fieldLine, '\r') != -1 {
+			return 0, false, ErrorBareLineBreak
+		}
+
+		fieldName, fieldValue, err := parseHeader(fieldLine)
 
 		if err != nil {
 			return 0, false, err
 		}
 
-		h.Set(fieldName, fieldValue)
+		h.Add(fieldName, fieldValue)
 		readBytes += separatorIndex + len(SEPARATOR)
 	}
 
 	return readBytes, done, nil
 }
 
+// Get returns the values of key combined into one comma separated list.
+// Set-Cookie values can't be combined since cookies have commas in their
+// dates, Get returns the first one and Values all of them
 func (h *Headers) Get(key string) (string, bool) {
-	value, exists := h.headers[strings.ToLower(key)]
+	parsedKey := strings.ToLower(key)
+	field, exists := h.headers[parsedKey]
 
-	return value, exists
+	if !exists {
+		return "", false
+	}
+
+	if parsedKey == "set-cookie" {
+		return field.values[0], true
+	}
+
+	return strings.Join(field.values, ","), true
 }
 
-func (h *Headers) Set(key string, value string) {
-	parsedKey := strings.ToLower(key)
+// Values returns every value of key in the order they were added
+func (h *Headers) Values(key string) []string {
+	field, exists := h.headers[strings.ToLower(key)]
+
+	if !exists {
+		return nil
+	}
 
-	prev, exists := h.headers[parsedKey]
+	return slices.Clone(field.values)
+}
+
+// Add appends value to the values of key
+func (h *Headers) Add(key string, value string) {
+	parsedKey := strings.ToLower(key)
+	existing, exists := h.headers[parsedKey]
 
 	if exists {
-		h.headers[parsedKey] = fmt.Sprintf("%s,%s", prev, value)
-	} else {
-		h.headers[parsedKey] = value
+		existing.values = append(existing.values, value)
+		return
 	}
+
+	h.headers[parsedKey] = &field{name: key, values: []string{value}, order: h.added}
+	h.added++
 }
 
+// Set adds value to key like Add does, use Replace to drop the values
+// already there
+func (h *Headers) Set(key string, value string) {
+	h.Add(key, value)
+}
+
+// Replace makes value the only value of key, keeping its place in the
+// iteration order if it was already there
 func (h *Headers) Replace(key string, value string) {
 	parsedKey := strings.ToLower(key)
+	existing, exists := h.headers[parsedKey]
+
+	if exists {
+		existing.name = key
+		existing.values = []string{value}
+		return
+	}
 
-	h.headers[parsedKey] = value
+	h.Add(key, value)
+}
+
+// Clone returns a copy of h that can be changed without changing h
+func (h *Headers) Clone() Headers {
+	clone := *h
+	clone.headers = make(map[string]*field, len(h.headers))
+
+	for key, existing := range h.headers {
+		clone.headers[key] = &field{
+			name:   existing.name,
+			values: slices.Clone(existing.values),
+			order:  existing.order,
+		}
+	}
+
+	return clone
+}
+
+// Name returns key spelled the way it was set or received, or key itself if
+// there is no such field
+func (h *Headers) Name(key string) string {
+	field, exists := h.headers[strings.ToLower(key)]
+
+	if !exists {
+		return key
+	}
+
+	return field.name
+}
+
+// CanonicalName capitalizes the first letter of name and every letter after
+// a hyphen, lowercasing the rest: "content-type" becomes "Content-Type"
+func CanonicalName(name string) string {
+	canonical := []byte(strings.ToLower(name))
+	upper := true
+
+	for i, c := range canonical {
+		if upper && c >= 'a' && c <= 'z' {
+			canonical[i] = c - 'a' + 'A'
+		}
+		upper = c == '-'
+	}
+
+	return string(canonical)
 }
 
 func (h *Headers) Delete(key string) {
@@ -86,10 +226,75 @@ func (h *Headers) Delete(key string) {
 	delete(h.headers, parsedKey)
 }
 
+// HasToken reports whether the comma separated values of key contain token,
+// compared case-insensitively
+func (h *Headers) HasToken(key string, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ForEach calls cb with every value of every field, fields in the order they
+// were first added and each field's values in the order they were added
 func (h *Headers) ForEach(cb func(string, string)) {
-	for key, value := range h.headers {
-		cb(key, value)
+	keys := make([]string, 0, len(h.headers))
+
+	for key := range h.headers {
+		keys = append(keys, key)
 	}
+
+	slices.SortFunc(keys, func(a string, b string) int {
+		return h.headers[a].order - h.headers[b].order
+	})
+
+	for _, key := range keys {
+		for _, value := range h.headers[key].values {
+			cb(key, value)
+		}
+	}
+}
+
+// Validate checks every field has a token name and a value without control
+// characters, so writing them can't end a line early and forge fields
+func (h *Headers) Validate() error {
+	var err error
+
+	h.ForEach(func(key string, value string) {
+		switch {
+		case err != nil:
+		case !IsValidName(h.Name(key)):
+			err = fmt.Errorf("%w: %q", ErrorInvalidFieldName, h.Name(key))
+		case !IsValidValue(value):
+			err = fmt.Errorf("%w: %s", ErrorInvalidFieldValue, h.Name(key))
+		}
+	})
+
+	return err
+}
+
+// IsValidName reports whether name is a token as RFC 9110 defines it
+func IsValidName(name string) bool {
+	return fieldNamePattern.MatchString(name)
+}
+
+// IsValidValue reports whether value only has visible characters, spaces,
+// tabs and obs-text, CR, LF and NUL being the ones that matter
+func IsValidValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func parseHeader(fieldLine []byte) (string, string, error) {
@@ -105,18 +310,23 @@ func parseHeader(fieldLine []byte) (string, string, error) {
 		return "", "", err
 	}
 
-	fieldValue := bytes.TrimSpace(fieldLineParts[1])
+	fieldValue := bytes.Trim(fieldLineParts[1], " \t")
+
+	if !IsValidValue(string(fieldValue)) {
+		return "", "", ErrorInvalidFieldValue
+	}
 
 	return string(fieldName), string(fieldValue), nil
 }
 
+var fieldNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.\\^_`|~]+$")
+
 func parseFieldName(fieldName []byte) (string, error) {
-	re := regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.\\^_`|~]+$")
 	fieldNameStr := string(fieldName)
 
-	if !re.MatchString(fieldNameStr) {
+	if !IsValidName(fieldNameStr) {
 		return "", ErrorInvalidFieldName
 	}
 
-	return strings.ToLower(fieldNameStr), nil
+	return fieldNameStr, nil
 }
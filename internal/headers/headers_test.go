@@ -2,6 +2,7 @@ package headers
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -67,3 +68,216 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeadersValues(t *testing.T) {
+	// Test: Set-Cookie values are kept apart, commas in dates included
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\nSet-Cookie: b=2\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("set-cookie"))
+
+	cookie, exists := headers.Get("Set-Cookie")
+	assert.True(t, exists)
+	assert.Equal(t, "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", cookie)
+
+	// Test: Other fields are combined by Get and listed by Values
+	headers = NewHeaders()
+	headers.Add("Accept", "text/html")
+	headers.Add("accept", "application/json")
+	accept, _ := headers.Get("ACCEPT")
+	assert.Equal(t, "text/html,application/json", accept)
+	assert.Equal(t, []string{"text/html", "application/json"}, headers.Values("Accept"))
+	assert.Nil(t, headers.Values("missing"))
+
+	// Test: Iteration follows the order fields were first added
+	headers = NewHeaders()
+	headers.Add("Zeta", "1")
+	headers.Add("Alpha", "2")
+	headers.Add("Mid", "3")
+	headers.Add("Zeta", "4")
+	headers.Replace("Alpha", "5")
+	headers.Delete("Mid")
+	headers.Add("Mid", "6")
+
+	for i := 0; i < 10; i++ {
+		lines := []string{}
+		headers.ForEach(func(key string, value string) {
+			lines = append(lines, key+": "+value)
+		})
+		assert.Equal(t, []string{"zeta: 1", "zeta: 4", "alpha: 5", "mid: 6"}, lines)
+	}
+}
+
+func TestHeadersNames(t *testing.T) {
+	// Test: Received spelling is kept, lookup ignores case
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("x-Custom-ID: 7\r\nX-CUSTOM-id: 8\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "x-Custom-ID", headers.Name("X-CUSTOM-ID"))
+	assert.Equal(t, []string{"7", "8"}, headers.Values("x-custom-id"))
+
+	// Test: Replace takes the new spelling, unknown names are returned as is
+	headers.Replace("X-Custom-Id", "9")
+	assert.Equal(t, "X-Custom-Id", headers.Name("x-custom-id"))
+	assert.Equal(t, "Missing", headers.Name("Missing"))
+
+	// Test: Canonical names
+	assert.Equal(t, "Content-Type", CanonicalName("content-type"))
+	assert.Equal(t, "X-Request-Id", CanonicalName("X-REQUEST-ID"))
+	assert.Equal(t, "Host", CanonicalName("host"))
+	assert.Equal(t, "X-1st-Try", CanonicalName("x-1st-try"))
+}
+
+func TestHeadersParseLineBreaks(t *testing.T) {
+	// Test: Bare LF ending a field line
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("Host: localhost\nFoo: bar\r\n\r\n"))
+	require.ErrorIs(t, err, ErrorBareLineBreak)
+
+	// Test: Bare LF is caught before the line is complete
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("Host: localhost\nFoo"))
+	require.ErrorIs(t, err, ErrorBareLineBreak)
+
+	// Test: Bare LF ending the header section
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("Host: localhost\r\n\n"))
+	require.ErrorIs(t, err, ErrorBareLineBreak)
+
+	// Test: Bare CR inside a field value
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("Host: local\rhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrorBareLineBreak)
+
+	// Test: Whitespace between the field name and the colon
+	headers = NewHeaders()
+	_, _, err = headers.Parse([]byte("Content-Length : 5\r\n\r\n"))
+	require.ErrorIs(t, err, ErrorInvalidFieldName)
+}
+
+func TestHeadersValidation(t *testing.T) {
+	// Test: Control characters in received values
+	for _, line := range []string{"Foo: a\x00b\r\n\r\n", "Foo: a\x1bb\r\n\r\n", "Foo: a\x7fb\r\n\r\n"} {
+		headers := NewHeaders()
+		_, _, err := headers.Parse([]byte(line))
+		assert.ErrorIs(t, err, ErrorInvalidFieldValue, line)
+	}
+
+	// Test: Tabs and obs-text are fine
+	headers := NewHeaders()
+	_, done, err := headers.Parse([]byte("Foo: a\tb \xe9\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	// Test: Fields set by code are checked before they are written
+	headers = NewHeaders()
+	headers.Add("Location", "/ok")
+	require.NoError(t, headers.Validate())
+
+	headers.Add("Location", "/next\r\nSet-Cookie: admin=1")
+	assert.ErrorIs(t, headers.Validate(), ErrorInvalidFieldValue)
+
+	headers = NewHeaders()
+	headers.Add("Bad Name", "x")
+	assert.ErrorIs(t, headers.Validate(), ErrorInvalidFieldName)
+
+	headers = NewHeaders()
+	headers.Add("X-Injected\r\nFoo", "x")
+	assert.ErrorIs(t, headers.Validate(), ErrorInvalidFieldName)
+}
+
+func TestHeadersTypedValues(t *testing.T) {
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("Content-Length: 42\r\n" +
+		"Max-Forwards: 10, 10\r\n" +
+		"Age: 3, 4\r\n" +
+		"Retry-After: -1\r\n" +
+		"X-Big: 99999999999999999999\r\n" +
+		"Date: Sun, 06 Nov 1994 08:49:37 GMT\r\n" +
+		"If-Modified-Since: Sunday, 06-Nov-94 08:49:37 GMT\r\n" +
+		"If-Unmodified-Since: Sun Nov  6 08:49:37 1994\r\n" +
+		"Expires: tomorrow\r\n" +
+		"Cache-Control: no-cache, private=\"set-cookie, x-id\", , max-age=60\r\n" +
+		"Cache-Control: must-revalidate\r\n" +
+		"Accept: text/plain;q=0.5, text/html, application/json;q=0.9, */*;q=0, image/png;q=2\r\n" +
+		"Accept-Encoding: gzip;q=1.000, br;q=0.8;level=3, deflate;Q=0.8\r\n" +
+		"\r\n"))
+	require.NoError(t, err)
+
+	// Test: Integers, identical repeats allowed
+	n, err := headers.GetInt("content-length")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+
+	n, err = headers.GetInt("max-forwards")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+
+	// Test: Invalid and missing integers are errors, not zero
+	for _, key := range []string{"age", "retry-after", "x-big", "date"} {
+		_, err = headers.GetInt(key)
+		assert.ErrorIs(t, err, ErrorInvalidFieldValue, key)
+	}
+	_, err = headers.GetInt("missing")
+	assert.ErrorIs(t, err, ErrorFieldNotFound)
+
+	// Test: All three date formats
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, key := range []string{"date", "if-modified-since", "if-unmodified-since"} {
+		date, err := headers.GetTime(key)
+		require.NoError(t, err, key)
+		assert.True(t, want.Equal(date), key)
+	}
+	_, err = headers.GetTime("expires")
+	assert.ErrorIs(t, err, ErrorInvalidFieldValue)
+	_, err = headers.GetTime("missing")
+	assert.ErrorIs(t, err, ErrorFieldNotFound)
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatTime(want))
+
+	// Test: Lists keep quoted commas and span repeated fields
+	assert.Equal(t, []string{"no-cache", "private=\"set-cookie, x-id\"", "max-age=60", "must-revalidate"}, headers.GetList("cache-control"))
+	assert.Equal(t, []string{"a", "\"b\\\",c\"", "d"}, ParseList("a, \"b\\\",c\",d"))
+	assert.Empty(t, headers.GetList("missing"))
+
+	// Test: Quality values sorted by weight, malformed weights dropped
+	assert.Equal(t, []QualityValue{
+		{Value: "text/html", Q: 1},
+		{Value: "application/json", Q: 0.9},
+		{Value: "text/plain", Q: 0.5},
+		{Value: "*/*", Q: 0},
+	}, headers.GetQualityValues("accept"))
+
+	assert.Equal(t, []QualityValue{
+		{Value: "gzip", Q: 1},
+		{Value: "br", Q: 0.8},
+		{Value: "deflate", Q: 0.8},
+	}, headers.GetQualityValues("accept-encoding"))
+}
+
+func TestHeadersParseLimits(t *testing.T) {
+	// Test: Header section within the limits
+	headers := NewHeaders()
+	headers.SetLimits(64, 2)
+	data := []byte("Host: localhost:42069\r\nFoo: bar\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	// Test: Too many field lines
+	headers = NewHeaders()
+	headers.SetLimits(0, 2)
+	data = []byte("A: 1\r\nB: 2\r\nC: 3\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrorTooManyHeaders)
+
+	// Test: Header section too large across several calls
+	headers = NewHeaders()
+	headers.SetLimits(16, 0)
+	n, _, err := headers.Parse([]byte("Host: local\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 13, n)
+	_, _, err = headers.Parse([]byte("Foo: bar"))
+	require.ErrorIs(t, err, ErrorHeadersTooLarge)
+}
@@ -0,0 +1,205 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrorFieldNotFound = errors.New("field not found")
+
+// TimeFormat is the IMF-fixdate format dates are sent in
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// obsolete date formats recipients still have to accept
+var timeFormats = []string{
+	TimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// QualityValue is an element of an Accept style field with its weight
+type QualityValue struct {
+	// Value is the element without its weight, media type parameters
+	// before the weight are kept
+	Value string
+	Q     float64
+}
+
+// GetInt parses a non-negative integer field. Repeated values are accepted
+// as long as they are all the same, as RFC 9110 allows for Content-Length
+func (h *Headers) GetInt(key string) (int64, error) {
+	if _, exists := h.Get(key); !exists {
+		return 0, ErrorFieldNotFound
+	}
+
+	elements := h.GetList(key)
+
+	if len(elements) == 0 {
+		return 0, fmt.Errorf("%w: %s is empty", ErrorInvalidFieldValue, key)
+	}
+
+	for _, element := range elements {
+		if element != elements[0] || !isDigits(element) {
+			return 0, fmt.Errorf("%w: %s isn't an integer", ErrorInvalidFieldValue, key)
+		}
+	}
+
+	value, err := strconv.ParseInt(elements[0], 10, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s is out of range", ErrorInvalidFieldValue, key)
+	}
+
+	return value, nil
+}
+
+// GetTime parses a date field in any of the formats HTTP allows
+func (h *Headers) GetTime(key string) (time.Time, error) {
+	value, exists := h.Get(key)
+
+	if !exists {
+		return time.Time{}, ErrorFieldNotFound
+	}
+
+	return ParseTime(value)
+}
+
+// ParseTime parses an IMF-fixdate, RFC 850 or asctime date
+func ParseTime(value string) (time.Time, error) {
+	for _, format := range timeFormats {
+		if parsed, err := time.Parse(format, value); err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %q isn't a date", ErrorInvalidFieldValue, value)
+}
+
+// FormatTime formats t as an IMF-fixdate
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// GetList returns the elements of every value of key, split on the commas
+// that aren't inside a quoted string
+func (h *Headers) GetList(key string) []string {
+	elements := []string{}
+
+	for _, value := range h.Values(key) {
+		elements = append(elements, ParseList(value)...)
+	}
+
+	return elements
+}
+
+// ParseList splits a comma separated value, trimming whitespace around the
+// elements and dropping empty ones. Quoted strings are kept as they are
+func ParseList(value string) []string {
+	elements := []string{}
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case quoted && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+		case value[i] == ',' && !quoted:
+			elements = appendElement(elements, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return appendElement(elements, value[start:])
+}
+
+func appendElement(elements []string, element string) []string {
+	element = strings.Trim(element, " \t")
+
+	if element == "" {
+		return elements
+	}
+
+	return append(elements, element)
+}
+
+// GetQualityValues returns the elements of an Accept style field from the
+// most to the least preferred, elements of equal weight keeping their order.
+// Elements with a malformed weight are left out
+func (h *Headers) GetQualityValues(key string) []QualityValue {
+	values := []QualityValue{}
+
+	for _, element := range h.GetList(key) {
+		value, q, ok := parseQualityValue(element)
+
+		if ok {
+			values = append(values, QualityValue{Value: value, Q: q})
+		}
+	}
+
+	slices.SortStableFunc(values, func(a QualityValue, b QualityValue) int {
+		switch {
+		case a.Q > b.Q:
+			return -1
+		case a.Q < b.Q:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return values
+}
+
+// parseQualityValue splits the weight off an element, anything after it
+// being an accept extension that is dropped
+func parseQualityValue(element string) (string, float64, bool) {
+	params := strings.Split(element, ";")
+
+	for i := 1; i < len(params); i++ {
+		name, weight, _ := strings.Cut(strings.Trim(params[i], " \t"), "=")
+
+		if !strings.EqualFold(name, "q") {
+			continue
+		}
+
+		q, ok := parseWeight(weight)
+		value := strings.TrimRight(strings.Join(params[:i], ";"), " \t")
+
+		return value, q, ok
+	}
+
+	return element, 1, true
+}
+
+// parseWeight accepts 0 to 1 with at most three decimals
+func parseWeight(weight string) (float64, bool) {
+	integer, decimals, _ := strings.Cut(weight, ".")
+
+	if (integer != "0" && integer != "1") || len(decimals) > 3 || !isDigits(decimals) {
+		return 0, false
+	}
+
+	if integer == "1" && strings.Trim(decimals, "0") != "" {
+		return 0, false
+	}
+
+	q, err := strconv.ParseFloat(weight, 64)
+
+	return q, err == nil
+}
+
+func isDigits(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
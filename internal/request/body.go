@@ -0,0 +1,114 @@
+package request
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// maxBodyDrain is how much of an unread body Close discards to keep the
+// connection usable, anything bigger isn't worth reading just to throw away
+const maxBodyDrain = 256 * 1024
+
+var ErrorBodyClosed = errors.New("body is already closed")
+var ErrorBodyNotConsumed = errors.New("body is too big to be discarded")
+
+// body pulls a request's body off the connection as it's read
+type body struct {
+	reader   *Reader
+	request  *Request
+	err      error
+	read     int64
+	finished chan struct{}
+	once     sync.Once
+}
+
+func newBody(reader *Reader, request *Request) *body {
+	b := &body{
+		reader:   reader,
+		request:  request,
+		finished: make(chan struct{}),
+	}
+
+	if request.done() {
+		b.finish(io.EOF)
+	}
+
+	return b
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	r := b.reader
+
+	for {
+		numBytesParsed, written, err := b.request.parseBody(r.buf[:r.readToIndex], p)
+		r.consume(numBytesParsed)
+		b.read += int64(written)
+
+		// only chunked bodies get here, a too long content length is
+		// rejected with the headers
+		if limit := b.request.limits.MaxBodyBytes; limit > 0 && b.read > limit {
+			b.finish(ErrorBodyTooLarge)
+			return written - int(b.read-limit), ErrorBodyTooLarge
+		}
+
+		if err != nil {
+			b.finish(err)
+			return written, err
+		}
+
+		if b.request.done() {
+			b.finish(io.EOF)
+			return written, io.EOF
+		}
+
+		if written > 0 {
+			return written, nil
+		}
+
+		if r.err != nil {
+			err := r.eofError(b.request, true)
+			b.finish(err)
+			return 0, err
+		}
+
+		r.fill()
+	}
+}
+
+// Close discards the rest of the body so the next request can be read, it
+// fails if the body is too big for that and the connection should be closed
+func (b *body) Close() error {
+	if b.err == nil {
+		io.CopyN(io.Discard, b, maxBodyDrain)
+	}
+
+	if b.err == io.EOF || b.err == ErrorBodyClosed {
+		b.finish(ErrorBodyClosed)
+		return nil
+	}
+
+	if b.err == nil {
+		b.finish(ErrorBodyNotConsumed)
+		return ErrorBodyNotConsumed
+	}
+
+	return b.err
+}
+
+// finish makes err the result of every further read and lets the reader move
+// on to the next request
+func (b *body) finish(err error) {
+	b.err = err
+	b.once.Do(func() {
+		close(b.finished)
+	})
+}
@@ -2,10 +2,14 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"http-server/internal/headers"
 	"io"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -14,10 +18,40 @@ const bufferSize = 2048
 var SEPARATOR = "\r\n"
 var ErrorInvalidRequest = errors.New("request is invalid")
 var ErrorInvalidRequestLine = errors.New("request line is invalid")
-var ErrorInvalidHttpVersion = errors.New("http version is not supported")
+var ErrorInvalidHttpVersion = errors.New("http version is invalid")
+var ErrorHttpVersionNotSupported = errors.New("http version is not supported")
 var ErrorInvalidRequestTarget = errors.New("request target is invalid")
 var ErrorInvalidMethod = errors.New("method is invalid")
 var ErrorContentLengthMismatch = errors.New("body size isn't the same as content length")
+var ErrorInvalidChunkSize = errors.New("chunk size is invalid")
+var ErrorInvalidChunk = errors.New("chunk data isn't followed by a line break")
+var ErrorRequestLineTooLong = errors.New("request line is too long")
+var ErrorBodyTooLarge = errors.New("body is too large")
+var ErrorInvalidContentLength = errors.New("content length is invalid")
+var ErrorInvalidTransferEncoding = errors.New("transfer encoding is invalid")
+var ErrorUnsupportedTransferCoding = errors.New("transfer coding is not supported")
+var ErrorAmbiguousFraming = errors.New("request has both content length and transfer encoding")
+var ErrorMissingHost = errors.New("request has no host")
+var ErrorDuplicateHost = errors.New("request has more than one host")
+
+var httpVersionPattern = regexp.MustCompile(`^HTTP/[0-9](\.[0-9])?$`)
+
+// maxChunkSizeLine bounds a chunk-size line, extensions included
+const maxChunkSizeLine = 4096
+
+// Limits bounds how much of a request the parser accepts, zero means no limit
+type Limits struct {
+	MaxRequestLineBytes int
+	MaxHeaderBytes      int
+	MaxHeaderCount      int
+	MaxBodyBytes        int64
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 * 1024,
+	MaxHeaderBytes:      1024 * 1024,
+	MaxHeaderCount:      100,
+}
 
 type RequestState string
 
@@ -26,9 +60,16 @@ const (
 	RequestStateHeaders RequestState = "headers"
 	RequestStateBody    RequestState = "body"
 	RequestStateDone    RequestState = "done"
+
+	RequestStateChunkSize    RequestState = "chunk size"
+	RequestStateChunkData    RequestState = "chunk data"
+	RequestStateChunkDataEnd RequestState = "chunk data end"
+	RequestStateTrailers     RequestState = "trailers"
 )
 
 type RequestLine struct {
+	// HttpVersion is HTTP/1.0 or HTTP/1.1, later HTTP/1.x versions being
+	// handled as HTTP/1.1
 	HttpVersion   string
 	RequestTarget string
 	Method        string
@@ -36,13 +77,37 @@ type RequestLine struct {
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
-	state       RequestState
+	// Target is RequestLine.RequestTarget parsed
+	Target  Target
+	Headers headers.Headers
+	// Body streams the body from the connection, it has to be read or closed
+	// before the next request on the connection can be read
+	Body io.ReadCloser
+	// Trailers holds the fields sent after a chunked body, they are only
+	// available once Body has been read to the end
+	Trailers headers.Headers
+	// Params holds the path parameters captured by the route that matched,
+	// percent-decoded, RawParams the same parameters as they were sent
+	Params    map[string]string
+	RawParams map[string]string
+	state     RequestState
+	limits    Limits
+	ctx       context.Context
+	// remaining is what's left of the content length or of the current chunk
+	remaining int
 }
 
+// isValidHttpVersion checks the version looks like one, HTTP/3 included
+// so it can be told apart from garbage and answered with 505. HTTP/1 always
+// has a minor version
 func (r *RequestLine) isValidHttpVersion() bool {
-	return r.HttpVersion == "HTTP/1.1"
+	return httpVersionPattern.MatchString(r.HttpVersion) && r.HttpVersion != "HTTP/1"
+}
+
+// isSupportedHttpVersion accepts any HTTP/1.x, the major version being the
+// one that tells whether the message can be understood (RFC 9110 section 2.5)
+func (r *RequestLine) isSupportedHttpVersion() bool {
+	return strings.HasPrefix(r.HttpVersion, "HTTP/1.")
 }
 
 func (r *RequestLine) isValidRequestTarget() bool {
@@ -75,15 +140,75 @@ func (r *RequestLine) isValid() (bool, error) {
 	if !r.isValidMethod() {
 		return false, ErrorInvalidMethod
 	}
+	if !r.isSupportedHttpVersion() {
+		return false, ErrorHttpVersionNotSupported
+	}
 
 	return true, nil
 }
 
-func (r *Request) hasBody() bool {
-	len := getInt(&r.Headers, "content-length", 0)
-	return len > 0
+// checkHost follows RFC 9112 section 3.2: HTTP/1.1 requests need a Host
+// field and no request may have more than one, a comma in the value is two
+// hosts folded into one line
+func (r *Request) checkHost() error {
+	hosts := r.Headers.Values("host")
+
+	if len(hosts) > 1 || (len(hosts) == 1 && strings.Contains(hosts[0], ",")) {
+		return ErrorDuplicateHost
+	}
+
+	if len(hosts) == 0 && r.RequestLine.HttpVersion != "HTTP/1.0" {
+		return ErrorMissingHost
+	}
+
+	return nil
+}
+
+// bodyFraming works out how the body is delimited following RFC 9112 section
+// 6, rejecting the ambiguous framings request smuggling relies on. It returns
+// whether the body is chunked, and otherwise its length
+func (r *Request) bodyFraming() (bool, int, error) {
+	_, hasTransferEncoding := r.Headers.Get("transfer-encoding")
+	_, hasContentLength := r.Headers.Get("content-length")
+
+	if hasTransferEncoding && hasContentLength {
+		return false, 0, ErrorAmbiguousFraming
+	}
+
+	if hasTransferEncoding {
+		// HTTP/1.0 has no transfer codings, a proxy in front may not have
+		// framed the body the way we would
+		if r.RequestLine.HttpVersion == "HTTP/1.0" {
+			return false, 0, ErrorInvalidTransferEncoding
+		}
+
+		return true, 0, checkTransferEncoding(r.Headers.GetList("transfer-encoding"))
+	}
+
+	if hasContentLength {
+		length, err := r.Headers.GetInt("content-length")
+
+		if err != nil || length > math.MaxInt {
+			return false, 0, ErrorInvalidContentLength
+		}
+
+		return false, int(length), nil
+	}
+
+	return false, 0, nil
+}
+
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request, HTTP/1.0 clients have to ask for it
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine.HttpVersion == "HTTP/1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+
+	return !r.Headers.HasToken("connection", "close")
 }
 
+// parse reads the request line and headers, stopping once the body starts
 func (r *Request) parse(data []byte) (int, error) {
 	readBytes := 0
 
@@ -97,7 +222,7 @@ outer:
 
 		switch r.state {
 		case RequestStateInit:
-			requestLine, bytesConsumed, err := parseRequestLine(currentData)
+			requestLine, bytesConsumed, err := parseRequestLine(currentData, r.limits.MaxRequestLineBytes)
 
 			if err != nil {
 				return 0, err
@@ -107,7 +232,18 @@ outer:
 				break outer
 			}
 
+			target, err := parseTarget(requestLine.RequestTarget)
+
+			if err != nil {
+				return 0, err
+			}
+
+			if err := target.validateFor(requestLine.Method); err != nil {
+				return 0, err
+			}
+
 			r.RequestLine = *requestLine
+			r.Target = target
 			r.state = RequestStateHeaders
 			readBytes += bytesConsumed
 
@@ -125,25 +261,115 @@ outer:
 			readBytes += bytesConsumed
 
 			if done {
-				if r.hasBody() {
+				if err := r.checkHost(); err != nil {
+					return 0, err
+				}
+
+				isChunked, contentLength, err := r.bodyFraming()
+
+				if err != nil {
+					return 0, err
+				}
+
+				if isChunked {
+					r.state = RequestStateChunkSize
+				} else if contentLength > 0 {
+					r.remaining = contentLength
 					r.state = RequestStateBody
+
+					if r.limits.MaxBodyBytes > 0 && int64(r.remaining) > r.limits.MaxBodyBytes {
+						return 0, ErrorBodyTooLarge
+					}
 				} else {
 					r.state = RequestStateDone
 				}
 			}
 
-		case RequestStateBody:
-			contentLen := getInt(&r.Headers, "content-length", 0)
+		default:
+			break outer
+		}
+	}
+
+	return readBytes, nil
+}
+
+// parseBody decodes the body framing in data, copying body bytes into p
+// until it is full. It returns the bytes consumed from data and written to p
+func (r *Request) parseBody(data []byte, p []byte) (int, int, error) {
+	readBytes := 0
+	written := 0
+
+outer:
+	for {
+		currentData := data[readBytes:]
+
+		if len(currentData) == 0 {
+			break outer
+		}
+
+		switch r.state {
+		case RequestStateBody, RequestStateChunkData:
+			if written == len(p) {
+				break outer
+			}
+
+			n := copy(p[written:], currentData[:min(len(currentData), r.remaining)])
+			written += n
+			readBytes += n
+			r.remaining -= n
+
+			if r.remaining == 0 && r.state == RequestStateBody {
+				r.state = RequestStateDone
+			} else if r.remaining == 0 {
+				r.state = RequestStateChunkDataEnd
+			}
+
+		case RequestStateChunkSize:
+			chunkSize, bytesConsumed, err := parseChunkSize(currentData)
+
+			if err != nil {
+				return readBytes, written, err
+			}
+
+			if bytesConsumed == 0 {
+				break outer
+			}
+
+			readBytes += bytesConsumed
 
-			r.Body = append(r.Body, currentData...)
-			readBytes += len(currentData)
-			bodyLen := len(r.Body)
+			if chunkSize == 0 {
+				r.state = RequestStateTrailers
+			} else {
+				r.remaining = chunkSize
+				r.state = RequestStateChunkData
+			}
 
-			if bodyLen > contentLen {
-				return readBytes, ErrorContentLengthMismatch
+		case RequestStateChunkDataEnd:
+			if len(currentData) < len(SEPARATOR) {
+				break outer
+			}
+
+			if !bytes.HasPrefix(currentData, []byte(SEPARATOR)) {
+				return readBytes, written, ErrorInvalidChunk
+			}
+
+			readBytes += len(SEPARATOR)
+			r.state = RequestStateChunkSize
+
+		case RequestStateTrailers:
+			bytesConsumed, done, err := r.Trailers.Parse(currentData)
+
+			if err != nil {
+				return readBytes, written, err
 			}
 
-			if bodyLen == contentLen {
+			if bytesConsumed == 0 {
+				break outer
+			}
+
+			readBytes += bytesConsumed
+
+			if done {
 				r.state = RequestStateDone
 			}
 
@@ -155,63 +381,225 @@ outer:
 		}
 	}
 
-	return readBytes, nil
+	return readBytes, written, nil
+}
+
+func (r *Request) headersDone() bool {
+	return r.state != RequestStateInit && r.state != RequestStateHeaders
 }
 
 func (r *Request) done() bool {
 	return r.state == RequestStateDone
 }
 
-func newRequest() *Request {
-	return &Request{
-		state:   RequestStateInit,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
+// Context is cancelled when the client goes away, the server shuts down or
+// the handler's deadline passes
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
 	}
+
+	return r.ctx
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	request := newRequest()
-
-	for !request.done() {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
-		}
+// WithContext returns a shallow copy of the request carrying ctx, the body
+// is shared with the original
+func (r *Request) WithContext(ctx context.Context) *Request {
+	copy := *r
+	copy.ctx = ctx
+
+	return &copy
+}
+
+// Param returns the path parameter captured under name, or an empty string
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// RawParam returns the path parameter captured under name still
+// percent-encoded, to pass it on in another URL for instance
+func (r *Request) RawParam(name string) string {
+	return r.RawParams[name]
+}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+// ReadBody reads whatever is left of the body into memory
+func (r *Request) ReadBody() ([]byte, error) {
+	return io.ReadAll(r.Body)
+}
+
+func newRequest(limits Limits) *Request {
+	request := &Request{
+		state:    RequestStateInit,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		limits:   limits,
+	}
+
+	request.Headers.SetLimits(limits.MaxHeaderBytes, limits.MaxHeaderCount)
+	request.Trailers.SetLimits(limits.MaxHeaderBytes, limits.MaxHeaderCount)
+
+	return request
+}
+
+// Reader reads consecutive requests off a single connection, keeping any
+// bytes read past the end of one request for the next one
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	err         error
+	current     *body
+	limits      Limits
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewLimitedReader(reader, DefaultLimits)
+}
+
+func NewLimitedReader(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+		limits: limits,
+	}
+}
+
+// ReadRequest returns as soon as the headers are parsed, the body is read
+// from the connection as the caller reads Request.Body. It waits for the
+// previous request's body to be read or closed first, and returns io.EOF if
+// the connection ended cleanly before a new request started or the previous
+// body couldn't be consumed, and io.ErrUnexpectedEOF if it ended in the
+// middle of one
+func (r *Reader) ReadRequest() (*Request, error) {
+	r.Wait()
+
+	if !r.reusable() {
+		return nil, io.EOF
+	}
+
+	request := newRequest(r.limits)
+	started := r.readToIndex > 0
+
+	for {
+		numBytesParsed, err := request.parse(r.buf[:r.readToIndex])
 
 		if err != nil {
 			return nil, err
 		}
 
-		readToIndex += numBytesRead
+		r.consume(numBytesParsed)
 
-		numBytesParsed, err := request.parse(buf[:readToIndex])
+		if request.headersDone() {
+			r.current = newBody(r, request)
+			request.Body = r.current
+			return request, nil
+		}
 
-		if err != nil {
-			return nil, err
+		if r.err != nil {
+			return nil, r.eofError(request, started)
 		}
 
-		copy(buf, buf[numBytesParsed:readToIndex])
-		readToIndex -= numBytesParsed
+		if r.fill() > 0 {
+			started = true
+		}
+	}
+}
+
+// Wait blocks until the previous request's body has been read or closed
+func (r *Reader) Wait() {
+	if r.current != nil {
+		<-r.current.finished
+	}
+}
+
+// Peek blocks until the next request starts arriving, without the time limits
+// of reading it. Like ReadRequest it returns io.EOF if the connection ended or
+// the previous body couldn't be consumed
+func (r *Reader) Peek() error {
+	r.Wait()
+
+	if !r.reusable() {
+		return io.EOF
+	}
+
+	for r.readToIndex == 0 {
+		if r.err != nil {
+			return r.err
+		}
+
+		r.fill()
+	}
+
+	return nil
+}
+
+// reusable reports whether the previous request was consumed entirely, so
+// the next one starts at the beginning of the buffer
+func (r *Reader) reusable() bool {
+	return r.current == nil || r.current.request.done()
+}
+
+// fill reads more data from the connection into the buffer, growing it if
+// it's full. Read errors are kept and reported once the buffer is used up
+func (r *Reader) fill() int {
+	if r.readToIndex >= len(r.buf) {
+		newBuf := make([]byte, len(r.buf)*2)
+		copy(newBuf, r.buf)
+		r.buf = newBuf
+	}
+
+	numBytesRead, err := r.reader.Read(r.buf[r.readToIndex:])
+	r.readToIndex += numBytesRead
+
+	if err != nil {
+		r.err = err
 	}
 
-	return request, nil
+	return numBytesRead
 }
 
-func parseRequestLine(request []byte) (*RequestLine, int, error) {
+func (r *Reader) consume(n int) {
+	copy(r.buf, r.buf[n:r.readToIndex])
+	r.readToIndex -= n
+}
+
+func (r *Reader) eofError(request *Request, started bool) error {
+	if r.err != io.EOF {
+		return r.err
+	}
+
+	if !started {
+		return io.EOF
+	}
+
+	if request.state == RequestStateBody {
+		return ErrorContentLengthMismatch
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+func parseRequestLine(request []byte, maxLen int) (*RequestLine, int, error) {
 	separatorIndex := bytes.Index(request, []byte(SEPARATOR))
 
+	if maxLen > 0 && (separatorIndex > maxLen || separatorIndex == -1 && len(request) > maxLen) {
+		return nil, 0, ErrorRequestLineTooLong
+	}
+
 	if separatorIndex == -1 {
 		// still need more data
 		return nil, 0, nil
 	}
 
 	requestLineBytes := request[:separatorIndex]
+
+	if bytes.ContainsAny(requestLineBytes, "\r\n") {
+		return nil, 0, ErrorInvalidRequestLine
+	}
 	requestLineParts := bytes.Split(requestLineBytes, []byte(" "))
 	readBytes := separatorIndex + len(SEPARATOR)
 
@@ -231,21 +619,84 @@ func parseRequestLine(request []byte) (*RequestLine, int, error) {
 		return nil, 0, err
 	}
 
+	// a later minor version is a client able to speak HTTP/1.1
+	if requestLine.HttpVersion != "HTTP/1.0" {
+		requestLine.HttpVersion = "HTTP/1.1"
+	}
+
 	return &requestLine, readBytes, nil
 }
 
-func getInt(heads *headers.Headers, key string, defaultValue int) int {
-	value, exists := heads.Get(key)
+// parseChunkSize reads a chunk-size line, ignoring any chunk extensions
+func parseChunkSize(data []byte) (int, int, error) {
+	separatorIndex := bytes.Index(data, []byte(SEPARATOR))
+
+	if separatorIndex > maxChunkSizeLine || separatorIndex == -1 && len(data) > maxChunkSizeLine {
+		return 0, 0, ErrorInvalidChunkSize
+	}
 
-	if !exists {
-		return defaultValue
+	if separatorIndex == -1 {
+		// still need more data
+		return 0, 0, nil
 	}
 
-	valueAsInt, err := strconv.Atoi(value)
+	line := data[:separatorIndex]
+
+	// a bare line break hidden in an extension would end the line early for
+	// a more lenient parser
+	if bytes.ContainsAny(line, "\r\n") {
+		return 0, 0, ErrorInvalidChunkSize
+	}
+
+	if extIndex := bytes.IndexByte(line, ';'); extIndex != -1 {
+		line = line[:extIndex]
+	}
+
+	line = bytes.TrimRight(line, " \t")
+
+	if len(line) == 0 || !isHex(line) {
+		return 0, 0, ErrorInvalidChunkSize
+	}
+
+	chunkSize, err := strconv.ParseInt(string(line), 16, 32)
 
 	if err != nil {
-		return 0
+		return 0, 0, ErrorInvalidChunkSize
+	}
+
+	return int(chunkSize), separatorIndex + len(SEPARATOR), nil
+}
+
+func isHex(data []byte) bool {
+	for _, c := range data {
+		isDigit := c >= '0' && c <= '9'
+		isLetter := (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+
+		if !isDigit && !isLetter {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkTransferEncoding only allows the chunked coding, once, since it is the
+// only one the body reader can undo
+func checkTransferEncoding(codings []string) error {
+	chunked := 0
+
+	for _, coding := range codings {
+		switch {
+		case strings.EqualFold(coding, "chunked"):
+			chunked++
+		default:
+			return ErrorUnsupportedTransferCoding
+		}
+	}
+
+	if chunked != 1 {
+		return ErrorInvalidTransferEncoding
 	}
 
-	return valueAsInt
+	return nil
 }
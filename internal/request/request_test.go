@@ -1,7 +1,9 @@
 package request
 
 import (
+	"http-server/internal/headers"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,6 +56,36 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "HTTP/1.1", r.RequestLine.HttpVersion)
+
+	// Test: HTTP/1.0 is accepted but only kept alive on request
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Later HTTP/1.x minor versions are handled as HTTP/1.1
+	for _, version := range []string{"HTTP/1.2", "HTTP/1.9"} {
+		r, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err, version)
+		assert.Equal(t, "HTTP/1.1", r.RequestLine.HttpVersion, version)
+		assert.True(t, r.KeepAlive(), version)
+	}
+
+	// Test: Well formed versions that aren't supported
+	for _, version := range []string{"HTTP/2.0", "HTTP/3", "HTTP/0.9", "HTTP/2.1"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrorHttpVersionNotSupported, version)
+	}
+
+	// Test: Malformed versions
+	for _, version := range []string{"http/1.1", "HTTP/1.1.1", "HTTP/11", "HTTP/", "HTTP/1"} {
+		_, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\nHost: localhost\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrorInvalidHttpVersion, version)
+	}
 }
 
 func TestRequestHeadersParse(t *testing.T) {
@@ -97,7 +129,9 @@ func TestRequestBodyParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -108,6 +142,412 @@ func TestRequestBodyParse(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrorContentLengthMismatch)
+
+	// Test: Body is read lazily, headers are available before it arrives
+	conn := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:80\r\n" +
+			"Content-Length: 4\r\n" +
+			"\r\n" +
+			"data",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, len(conn.data)-4, conn.pos)
+	buf := make([]byte, 2)
+	n, err := r.Body.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "da", string(buf[:n]))
+	n, err = r.Body.Read(buf)
+	assert.Equal(t, "ta", string(buf[:n]))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderMultipleRequests(t *testing.T) {
+	// Test: Body followed by another request on the same connection
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Connection: close\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, r.KeepAlive())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Clean end of connection between requests
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection ends in the middle of a request
+	reader = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: local",
+		numBytesPerRead: 4,
+	})
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Unread body is discarded when closed
+	reader = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestRequestChunkedBodyParse(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := NewReader(&chunkReader{
+		data: "POST /logs HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\n" +
+			"hello\r\n" +
+			"7\r\n" +
+			" world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n" +
+			"GET / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+
+	checksum, _ := r.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+
+	// Test: Invalid chunk size
+	reader = NewReader(&chunkReader{
+		data: "POST /logs HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"-5\r\n" +
+			"hello\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrorInvalidChunkSize)
+
+	// Test: Chunk data longer than its size
+	reader = NewReader(&chunkReader{
+		data: "POST /logs HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\n" +
+			"hello\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrorInvalidChunk)
+
+	// Test: Connection ends before the last chunk
+	reader = NewReader(&chunkReader{
+		data: "POST /logs HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\n" +
+			"hello\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Unread body is discarded when closed
+	reader = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	// Test: Known smuggling payloads are rejected before the body is read
+	host := "Host: localhost\r\n"
+	corpus := []struct {
+		name    string
+		payload string
+		err     error
+	}{
+		{"CL.TE", host + "Content-Length: 13\r\nTransfer-Encoding: chunked\r\n", ErrorAmbiguousFraming},
+		{"TE.CL", host + "Transfer-Encoding: chunked\r\nContent-Length: 4\r\n", ErrorAmbiguousFraming},
+		{"differing duplicate CL", host + "Content-Length: 5\r\nContent-Length: 6\r\n", ErrorInvalidContentLength},
+		{"differing CL list", host + "Content-Length: 5, 6\r\n", ErrorInvalidContentLength},
+		{"signed CL", host + "Content-Length: +5\r\n", ErrorInvalidContentLength},
+		{"negative CL", host + "Content-Length: -1\r\n", ErrorInvalidContentLength},
+		{"hex CL", host + "Content-Length: 0x5\r\n", ErrorInvalidContentLength},
+		{"empty CL", host + "Content-Length: \r\n", ErrorInvalidContentLength},
+		{"overflowing CL", host + "Content-Length: 99999999999999999999\r\n", ErrorInvalidContentLength},
+		{"unknown coding", host + "Transfer-Encoding: gzip\r\n", ErrorUnsupportedTransferCoding},
+		{"obfuscated chunked", host + "Transfer-Encoding: xchunked\r\n", ErrorUnsupportedTransferCoding},
+		{"chunked not last", host + "Transfer-Encoding: chunked, identity\r\n", ErrorUnsupportedTransferCoding},
+		{"duplicate TE", host + "Transfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n", ErrorUnsupportedTransferCoding},
+		{"chunked twice", host + "Transfer-Encoding: chunked, chunked\r\n", ErrorInvalidTransferEncoding},
+		{"empty TE", host + "Transfer-Encoding: \r\n", ErrorInvalidTransferEncoding},
+		{"space before colon", host + "Transfer-Encoding : chunked\r\n", headers.ErrorInvalidFieldName},
+		{"obs-fold TE", host + "Foo: bar\r\n Transfer-Encoding: chunked\r\n", headers.ErrorInvalidFieldName},
+		{"bare LF header", host + "Foo: bar\nTransfer-Encoding: chunked\r\n", headers.ErrorBareLineBreak},
+		{"bare CR header", host + "Foo: bar\rTransfer-Encoding: chunked\r\n", headers.ErrorBareLineBreak},
+		{"missing Host", "Content-Length: 5\r\n", ErrorMissingHost},
+		{"duplicate Host", host + "Host: evil.example\r\n", ErrorDuplicateHost},
+		{"Host list", "Host: localhost, evil.example\r\n", ErrorDuplicateHost},
+	}
+
+	for _, test := range corpus {
+		_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" + test.payload + "\r\n0\r\n\r\n"))
+		assert.ErrorIs(t, err, test.err, test.name)
+	}
+
+	// Test: HTTP/1.0 clients may leave out the Host
+	_, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Transfer encoding from an HTTP/1.0 client
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrorInvalidTransferEncoding)
+
+	// Test: Bare LF in the request line
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\nHost: localhost\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrorInvalidRequestLine)
+
+	// Test: Bare LF hidden in a chunk extension
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5;a\n0\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrorInvalidChunkSize)
+
+	// Test: Identical duplicate content lengths and case-insensitive chunked are fine
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        8,
+	}
+
+	// Test: Request line too long, even before it's complete
+	reader := NewLimitedReader(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 64),
+		numBytesPerRead: 8,
+	}, limits)
+	_, err := reader.ReadRequest()
+	require.ErrorIs(t, err, ErrorRequestLineTooLong)
+
+	// Test: Header section too large
+	reader = NewLimitedReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n",
+		numBytesPerRead: 8,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, headers.ErrorHeadersTooLarge)
+
+	// Test: Content length over the body limit
+	reader = NewLimitedReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\n123456789",
+		numBytesPerRead: 8,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrorBodyTooLarge)
+
+	// Test: Chunked body growing over the body limit
+	reader = NewLimitedReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n",
+		numBytesPerRead: 8,
+	}, limits)
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.ErrorIs(t, err, ErrorBodyTooLarge)
+	assert.Equal(t, "12345678", string(body))
+}
+
+func TestRequestTargetParse(t *testing.T) {
+	parseWith := func(method string, target string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	}
+	parse := func(target string) (*Request, error) {
+		return parseWith("GET", target)
+	}
+
+	// Test: Origin form with a decoded, normalized path and a query
+	r, err := parse("/a/./b/../c%20d/?tag=x&tag=y+z&empty=&flag")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormOrigin, r.Target.Form)
+	assert.Equal(t, "/a/c d/", r.Target.Path)
+	assert.Equal(t, "/a/./b/../c%20d/", r.Target.RawPath)
+	assert.Equal(t, []string{"x", "y z"}, r.Target.Query["tag"])
+	assert.Equal(t, "x", r.Target.Query.Get("tag"))
+	assert.True(t, r.Target.Query.Has("empty"))
+	assert.True(t, r.Target.Query.Has("flag"))
+
+	// Test: Dot segments can't climb above the root
+	r, err = parse("/../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/passwd", r.Target.Path)
+
+	// Test: Raw segments keep encoded slashes and resolve dot segments,
+	// encoded ones included
+	r, err = parse("/a/%2e/b/%2E%2e/c%2Fd/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c%2Fd", ""}, r.Target.RawSegments())
+	assert.Equal(t, "/a/c/d/", r.Target.Path)
+
+	for target, segments := range map[string][]string{"/": {""}, "/..": {""}, "/a/..": {""}, "/a/b/..": {"a", ""}, "/a": {"a"}} {
+		r, err = parse(target)
+		require.NoError(t, err)
+		assert.Equal(t, segments, r.Target.RawSegments(), target)
+	}
+
+	// Test: Encoded dot segments are resolved too
+	r, err = parse("/static/%2e%2e/secret")
+	require.NoError(t, err)
+	assert.Equal(t, "/secret", r.Target.Path)
+
+	// Test: Absolute form
+	r, err = parse("http://Example.com:8080?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAbsolute, r.Target.Form)
+	assert.Equal(t, "http", r.Target.Scheme)
+	assert.Equal(t, "Example.com:8080", r.Target.Host)
+	assert.Equal(t, "/", r.Target.Path)
+	assert.Equal(t, "1", r.Target.Query.Get("q"))
+
+	// Test: Authority form for CONNECT
+	r, err = parseWith("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAuthority, r.Target.Form)
+	assert.Equal(t, "example.com:443", r.Target.Host)
+	assert.Equal(t, "example.com", r.Target.Hostname())
+	assert.Equal(t, "443", r.Target.Port())
+
+	// Test: IPv6 literal authority
+	r, err = parseWith("CONNECT", "[::1]:8443")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", r.Target.Hostname())
+	assert.Equal(t, "8443", r.Target.Port())
+
+	// Test: Asterisk form for OPTIONS
+	r, err = parseWith("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAsterisk, r.Target.Form)
+
+	// Test: OPTIONS can still target a resource
+	r, err = parseWith("OPTIONS", "/users")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormOrigin, r.Target.Form)
+
+	// Test: Forms not allowed for the method
+	for _, line := range [][2]string{
+		{"GET", "example.com:443"},
+		{"GET", "*"},
+		{"POST", "*"},
+		{"CONNECT", "/"},
+		{"CONNECT", "http://example.com:443/"},
+		{"CONNECT", "*"},
+	} {
+		_, err = parseWith(line[0], line[1])
+		assert.ErrorIs(t, err, ErrorInvalidRequestTarget, line)
+	}
+
+	// Test: Malformed authorities
+	for _, target := range []string{"example.com", "example.com:", "example.com:99999", "example.com:8o", "[::1", "[nope]:443", "user@example.com:443", ":443"} {
+		_, err = parseWith("CONNECT", target)
+		assert.ErrorIs(t, err, ErrorInvalidRequestTarget, target)
+	}
+
+	// Test: Malformed absolute form hosts
+	for _, target := range []string{"http:///path", "http://user@host/", "http://host:port/"} {
+		_, err = parse(target)
+		assert.ErrorIs(t, err, ErrorInvalidRequestTarget, target)
+	}
+
+	// Test: Characters that can't appear in a URI
+	for _, target := range []string{"/a\"b", "/<script>", "/a{b}", "/a|b", "/a\\b", "/caf\xc3\xa9"} {
+		_, err = parse(target)
+		assert.ErrorIs(t, err, ErrorInvalidRequestTarget, target)
+	}
+
+	// Test: Malformed percent encoding
+	for _, target := range []string{"/a%2", "/a%zz", "/?q=%G1", "/a%00b"} {
+		_, err = parse(target)
+		assert.ErrorIs(t, err, ErrorInvalidRequestTarget, target)
+	}
 }
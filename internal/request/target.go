@@ -0,0 +1,374 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type TargetForm string
+
+const (
+	TargetFormOrigin    TargetForm = "origin"
+	TargetFormAbsolute  TargetForm = "absolute"
+	TargetFormAuthority TargetForm = "authority"
+	TargetFormAsterisk  TargetForm = "asterisk"
+)
+
+// Query maps each query parameter to its values in the order they were sent
+type Query map[string][]string
+
+// Get returns the first value of key, or an empty string
+func (q Query) Get(key string) string {
+	values := q[key]
+
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func (q Query) Has(key string) bool {
+	_, exists := q[key]
+
+	return exists
+}
+
+// Target is the request target broken into its parts
+type Target struct {
+	Form TargetForm
+	// Scheme and Host are only set for absolute and authority form targets,
+	// Host includes the port if there is one
+	Scheme string
+	Host   string
+	// Path is percent-decoded with its dot segments removed, RawPath is
+	// the path as it was sent
+	Path     string
+	RawPath  string
+	Query    Query
+	RawQuery string
+	Fragment string
+}
+
+// Hostname returns Host without its port
+func (t Target) Hostname() string {
+	host, _ := splitHostPort(t.Host)
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// RawSegments returns the segments of RawPath, still percent-encoded, with
+// the dot segments resolved as they are for Path. An encoded slash stays
+// inside its segment, a path ending with a slash has an empty last segment
+func (t Target) RawSegments() []string {
+	return splitSegments(t.RawPath, func(part string) string {
+		decoded, _ := percentDecode(part, false)
+		return decoded
+	})
+}
+
+// Port returns the port of Host, or an empty string if there is none
+func (t Target) Port() string {
+	_, port := splitHostPort(t.Host)
+
+	return port
+}
+
+// validateFor checks the target's form is allowed for method: authority form
+// is only for CONNECT, which can't use any other, and asterisk form only for
+// a server wide OPTIONS
+func (t Target) validateFor(method string) error {
+	switch {
+	case method == "CONNECT" && t.Form != TargetFormAuthority:
+		return fmt.Errorf("%w: CONNECT needs an authority form target", ErrorInvalidRequestTarget)
+	case method != "CONNECT" && t.Form == TargetFormAuthority:
+		return fmt.Errorf("%w: authority form target is only allowed for CONNECT", ErrorInvalidRequestTarget)
+	case method != "OPTIONS" && t.Form == TargetFormAsterisk:
+		return fmt.Errorf("%w: asterisk form target is only allowed for OPTIONS", ErrorInvalidRequestTarget)
+	}
+
+	return nil
+}
+
+func parseTarget(raw string) (Target, error) {
+	for i := 0; i < len(raw); i++ {
+		if !isTargetChar(raw[i]) {
+			return Target{}, fmt.Errorf("%w: invalid character %q", ErrorInvalidRequestTarget, raw[i])
+		}
+	}
+
+	target := Target{Query: Query{}}
+
+	switch {
+	case raw == "*":
+		target.Form = TargetFormAsterisk
+		return target, nil
+
+	case strings.HasPrefix(raw, "/"):
+		target.Form = TargetFormOrigin
+
+	case hasScheme(raw):
+		target.Form = TargetFormAbsolute
+		schemeEnd := strings.Index(raw, "://")
+		target.Scheme = strings.ToLower(raw[:schemeEnd])
+		raw = raw[schemeEnd+len("://"):]
+
+		authorityEnd := strings.IndexAny(raw, "/?#")
+		if authorityEnd == -1 {
+			authorityEnd = len(raw)
+		}
+
+		target.Host = raw[:authorityEnd]
+		raw = raw[authorityEnd:]
+
+		if !isValidAuthority(target.Host, false) {
+			return Target{}, fmt.Errorf("%w: invalid authority", ErrorInvalidRequestTarget)
+		}
+
+		if !strings.HasPrefix(raw, "/") {
+			raw = "/" + raw
+		}
+
+	default:
+		target.Form = TargetFormAuthority
+
+		if !isValidAuthority(raw, true) {
+			return Target{}, fmt.Errorf("%w: invalid authority", ErrorInvalidRequestTarget)
+		}
+
+		target.Host = raw
+		return target, nil
+	}
+
+	raw, target.Fragment, _ = strings.Cut(raw, "#")
+	target.RawPath, target.RawQuery, _ = strings.Cut(raw, "?")
+
+	path, err := percentDecode(target.RawPath, false)
+
+	if err != nil {
+		return Target{}, err
+	}
+
+	target.Path = removeDotSegments(path)
+	target.Query, err = parseQuery(target.RawQuery)
+
+	if err != nil {
+		return Target{}, err
+	}
+
+	return target, nil
+}
+
+// hasScheme reports whether raw starts with a URI scheme followed by "://"
+func hasScheme(raw string) bool {
+	schemeEnd := strings.Index(raw, "://")
+
+	if schemeEnd <= 0 {
+		return false
+	}
+
+	for i := 0; i < schemeEnd; i++ {
+		c := raw[i]
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isOther := (c >= '0' && c <= '9') || c == '+' || c == '-' || c == '.'
+
+		if !isLetter && (i == 0 || !isOther) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isTargetChar reports whether c may appear in a request target, which is
+// made of URI characters only
+func isTargetChar(c byte) bool {
+	return isUnreserved(c) || isSubDelim(c) || strings.IndexByte(":@/?#%[]", c) != -1
+}
+
+func isUnreserved(c byte) bool {
+	isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	isDigit := c >= '0' && c <= '9'
+
+	return isLetter || isDigit || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isSubDelim(c byte) bool {
+	return strings.IndexByte("!$&'()*+,;=", c) != -1
+}
+
+// splitHostPort splits an authority at the port separator, keeping the
+// brackets of an IP literal
+func splitHostPort(authority string) (string, string) {
+	portStart := strings.LastIndexByte(authority, ':')
+
+	if portStart == -1 || strings.LastIndexByte(authority, ']') > portStart {
+		return authority, ""
+	}
+
+	return authority[:portStart], authority[portStart+1:]
+}
+
+// isValidAuthority checks host[:port] where host is a registered name, an IPv4
+// address or a bracketed IPv6 literal. Authority form targets need the port
+func isValidAuthority(authority string, needsPort bool) bool {
+	host, port := splitHostPort(authority)
+	hasPort := len(host) < len(authority)
+
+	if hasPort && !isValidPort(port) || needsPort && (!hasPort || port == "") {
+		return false
+	}
+
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		return ip != nil && strings.Contains(host, ":")
+	}
+
+	if host == "" {
+		return false
+	}
+
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+
+		if !isUnreserved(c) && !isSubDelim(c) && c != '%' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidPort accepts an empty port, which URIs allow, or one up to 65535
+func isValidPort(port string) bool {
+	if len(port) > 5 {
+		return false
+	}
+
+	value := 0
+
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+		value = value*10 + int(port[i]-'0')
+	}
+
+	return value <= 65535
+}
+
+func parseQuery(raw string) (Query, error) {
+	query := Query{}
+
+	if raw == "" {
+		return query, nil
+	}
+
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+
+		key, err := percentDecode(rawKey, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := percentDecode(rawValue, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		query[key] = append(query[key], value)
+	}
+
+	return query, nil
+}
+
+// percentDecode decodes %XX escapes, and '+' as a space in query components.
+// A decoded NUL is rejected since nothing downstream expects one
+func percentDecode(raw string, isQuery bool) (string, error) {
+	if !strings.ContainsAny(raw, "%+") {
+		return raw, nil
+	}
+
+	decoded := make([]byte, 0, len(raw))
+
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+
+		switch {
+		case c == '%':
+			if i+2 >= len(raw) || !isHex([]byte(raw[i+1:i+3])) {
+				return "", fmt.Errorf("%w: malformed percent encoding", ErrorInvalidRequestTarget)
+			}
+
+			b := unhex(raw[i+1])<<4 | unhex(raw[i+2])
+
+			if b == 0 {
+				return "", fmt.Errorf("%w: encoded NUL", ErrorInvalidRequestTarget)
+			}
+
+			decoded = append(decoded, b)
+			i += 2
+
+		case c == '+' && isQuery:
+			decoded = append(decoded, ' ')
+
+		default:
+			decoded = append(decoded, c)
+		}
+	}
+
+	return string(decoded), nil
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// removeDotSegments resolves "." and ".." segments of an absolute path as in
+// RFC 3986 section 5.2.4, ".." never going above the root
+func removeDotSegments(path string) string {
+	return "/" + strings.Join(splitSegments(path, func(part string) string { return part }), "/")
+}
+
+// splitSegments splits an absolute path into its segments with the dot
+// segments resolved, decode telling what a segment reads as. A path ending
+// with a slash, "/" included, has an empty last segment
+func splitSegments(path string, decode func(string) string) []string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	segments := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		switch decode(part) {
+		case ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, part)
+		}
+	}
+
+	last := decode(parts[len(parts)-1])
+
+	if len(segments) == 0 || last == "." || last == ".." {
+		segments = append(segments, "")
+	}
+
+	return segments
+}
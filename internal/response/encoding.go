@@ -0,0 +1,152 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"http-server/internal/headers"
+	"io"
+)
+
+// ContentEncoder compresses response bodies for one content coding, see
+// (*Writer).SetEncoder
+type ContentEncoder struct {
+	// Coding is the Content-Encoding the body is sent with, such as gzip
+	Coding string
+	// NewWriter returns a compressor writing to w
+	NewWriter func(w io.Writer) io.WriteCloser
+	// Accept decides whether to encode a response given its headers and the
+	// length of its body, -1 if it isn't known yet. It may change the headers,
+	// to add a Vary field for instance
+	Accept func(heads *headers.Headers, length int) bool
+}
+
+// SetEncoder makes the writer compress the body when the encoder accepts the
+// response once its headers are known. The body then goes out chunked, or
+// with the length of the compressed body if Write buffered all of it
+func (w *Writer) SetEncoder(encoder *ContentEncoder) {
+	w.encoder = encoder
+}
+
+// startEncoding asks the encoder about a response about to get heads and
+// returns the headers to write, switched to chunked if the body is encoded
+func (w *Writer) startEncoding(heads headers.Headers) headers.Headers {
+	if !w.canEncode(&heads) {
+		return heads
+	}
+
+	encoder := w.encoder
+	w.encoder = nil
+	length := -1
+
+	if contentLength, err := heads.GetInt("content-length"); err == nil && !heads.HasToken("transfer-encoding", "chunked") {
+		length = int(contentLength)
+	}
+
+	encoded := heads.Clone()
+
+	if !encoder.Accept(&encoded, length) {
+		return encoded
+	}
+
+	encoded.Replace("Content-Encoding", encoder.Coding)
+	encoded.Delete("Content-Length")
+	encoded.Replace("Transfer-Encoding", "chunked")
+
+	// a HEAD response only needs the headers the GET one gets, its body is
+	// dropped before it would reach the compressor
+	if !w.head {
+		w.encoding = encoder.NewWriter(chunkWriter{w})
+	}
+
+	return encoded
+}
+
+// encodeWhole compresses a body Write buffered entirely if the encoder
+// accepts it, setting Content-Encoding in Header()
+func (w *Writer) encodeWhole(body []byte) ([]byte, error) {
+	if !w.canEncode(&w.header) {
+		return body, nil
+	}
+
+	encoder := w.encoder
+	w.encoder = nil
+
+	if !encoder.Accept(&w.header, len(body)) {
+		return body, nil
+	}
+
+	encoded := &bytes.Buffer{}
+	compressor := encoder.NewWriter(encoded)
+
+	if _, err := compressor.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	w.header.Replace("Content-Encoding", encoder.Coding)
+
+	return encoded.Bytes(), nil
+}
+
+// canEncode reports whether there's a decision left to make, a response
+// without a body or one the handler already encoded is left alone
+func (w *Writer) canEncode(heads *headers.Headers) bool {
+	_, encoded := heads.Get("content-encoding")
+
+	return w.encoder != nil && !w.hasNoBody() && !encoded
+}
+
+// endEncoding flushes what the compressor holds and writes the last chunk
+func (w *Writer) endEncoding(hasTrailers bool) error {
+	if err := w.encoding.Close(); err != nil {
+		return err
+	}
+
+	w.state = WriterStateDone
+
+	if hasTrailers {
+		w.state = WriterStateTrailers
+	}
+
+	if w.http10 {
+		return nil
+	}
+
+	if hasTrailers {
+		_, err := w.writer.Write([]byte("0\r\n"))
+		return err
+	}
+
+	_, err := w.writer.Write([]byte("0\r\n\r\n"))
+
+	return err
+}
+
+// chunkWriter frames the compressor's output as chunks, HTTP/1.0 clients
+// getting it as is
+type chunkWriter struct {
+	w *Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if c.w.http10 {
+		return c.w.writer.Write(p)
+	}
+
+	buf := fmt.Appendf(nil, "%X\r\n", len(p))
+	buf = append(buf, p...)
+	buf = append(buf, "\r\n"...)
+
+	if _, err := c.w.writer.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -1,44 +1,382 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"http-server/internal/headers"
 	"io"
+	"strconv"
 )
 
-type StatusCode int
-
-type Writer struct {
-	writer io.Writer
-}
+type WriterState string
 
 const (
-	StatusOk                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	WriterStateStatusLine WriterState = "status line"
+	WriterStateHeaders    WriterState = "headers"
+	WriterStateBody       WriterState = "body"
+	WriterStateTrailers   WriterState = "trailers"
+	WriterStateDone       WriterState = "done"
 )
 
+var ErrorInvalidWriterState = errors.New("write is out of order")
+var ErrorContentLengthExceeded = errors.New("body is longer than content length")
+var ErrorInvalidStatusCode = errors.New("status code isn't three digits")
+var ErrorInvalidReasonPhrase = errors.New("reason phrase has invalid characters")
+
+// autoFramingThreshold is how much of a body Write buffers to send it with a
+// Content-Length before it switches to chunked encoding
+const autoFramingThreshold = 8 * 1024
+
+// Flusher is implemented by writers that hold data back until flushed,
+// writers passed to Wrap should implement it if they buffer
+type Flusher interface {
+	Flush() error
+}
+
+type Writer struct {
+	writer        io.Writer
+	buffer        *bufio.Writer
+	state         WriterState
+	statusCode    StatusCode
+	keepAlive     bool
+	chunked       bool
+	contentLength int
+	bodyWritten   int
+	http10        bool
+	head          bool
+	rawHeaderCase bool
+	// header is what Write sends once it knows how to frame the body,
+	// pending is the body it holds back until then
+	header  headers.Headers
+	pending []byte
+	auto    bool
+	// encoder decides whether to compress the body, encoding is the
+	// compressor once it did
+	encoder  *ContentEncoder
+	encoding io.WriteCloser
+}
+
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		writer: w,
+		writer:        w,
+		state:         WriterStateStatusLine,
+		keepAlive:     true,
+		contentLength: -1,
+		header:        headers.NewHeaders(),
+	}
+}
+
+// NewBufferedWriter is NewWriter with writes collected in a buffer of size
+// bytes, they reach w when it fills up or on Flush and Finish
+func NewBufferedWriter(w io.Writer, size int) *Writer {
+	buffer := bufio.NewWriterSize(w, size)
+	writer := NewWriter(buffer)
+	writer.buffer = buffer
+
+	return writer
+}
+
+// DisableKeepAlive makes the response announce and cause the connection to be
+// closed once it is written
+func (w *Writer) DisableKeepAlive() {
+	w.keepAlive = false
+}
+
+// UseHttp10 adapts the response to an HTTP/1.0 client, which doesn't know
+// chunked encoding: a chunked body is sent as is and delimited by closing the
+// connection, its trailers are dropped
+func (w *Writer) UseHttp10() {
+	w.http10 = true
+}
+
+// UseHead answers a HEAD request: the headers are written as they would be
+// for a GET, Content-Length included, but the body is dropped
+func (w *Writer) UseHead() {
+	w.head = true
+}
+
+// UseRawHeaderCase writes header names spelled the way they were set instead
+// of in their canonical Content-Type form
+func (w *Writer) UseRawHeaderCase() {
+	w.rawHeaderCase = true
+}
+
+// headerName is how key goes out on the wire
+func (w *Writer) headerName(heads *headers.Headers, key string) string {
+	if w.rawHeaderCase {
+		return heads.Name(key)
+	}
+
+	return headers.CanonicalName(key)
+}
+
+// KeepAlive reports whether the connection can serve another request after
+// this response, which requires the response to be complete and self-delimiting
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive && w.isComplete()
+}
+
+// Written reports whether anything of the response has been written
+func (w *Writer) Written() bool {
+	return w.state != WriterStateStatusLine
+}
+
+// StatusCode returns the status that was written, zero if none was
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns how many body bytes were written, not counting chunk
+// framing, including those Write is holding back
+func (w *Writer) BytesWritten() int {
+	return w.bodyWritten + len(w.pending)
+}
+
+// Wrap routes everything written from now on through the writer returned by
+// wrap, which gets the current destination. Middleware use it to observe or
+// transform the response on its way out, a wrapper that buffers should
+// implement Flusher and flush the writer it was given too
+func (w *Writer) Wrap(wrap func(io.Writer) io.Writer) {
+	w.writer = wrap(w.writer)
+}
+
+// Header returns the fields Write sends with the body, set them before the
+// first Write. WriteHeaders ignores them
+func (w *Writer) Header() *headers.Headers {
+	return &w.header
+}
+
+// Write writes p as part of the body, the status line defaulting to 200.
+// Unless Header() already has a Content-Length or Transfer-Encoding, the body
+// is buffered so it can go out with a Content-Length, and sent chunked once it
+// grows past a threshold or Flush is called. After WriteHeaders it writes
+// with whatever framing the headers set
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.state == WriterStateStatusLine {
+		if err := w.WriteStatusLine(StatusOk); err != nil {
+			return 0, err
+		}
+	}
+
+	if w.state == WriterStateHeaders {
+		if !w.auto && w.hasFraming() {
+			if err := w.WriteHeaders(w.header); err != nil {
+				return 0, err
+			}
+		} else {
+			w.auto = true
+			w.pending = append(w.pending, p...)
+
+			if len(w.pending) > autoFramingThreshold {
+				if err := w.writeBuffered(true); err != nil {
+					return 0, err
+				}
+			}
+
+			return len(p), nil
+		}
+	}
+
+	if w.chunked {
+		return w.WriteChunkedBody(p)
+	}
+
+	return w.WriteBody(p)
+}
+
+// Flush sends everything written so far to the client. A body Write was
+// holding back goes out chunked since its full length isn't known yet
+func (w *Writer) Flush() error {
+	if w.state == WriterStateStatusLine {
+		if err := w.WriteStatusLine(StatusOk); err != nil {
+			return err
+		}
+	}
+
+	if w.state == WriterStateHeaders {
+		if err := w.writeBuffered(true); err != nil {
+			return err
+		}
 	}
+
+	return w.flushBuffers()
+}
+
+// Finish completes a response written with Write, a buffered body going out
+// with its Content-Length and a chunked one getting its last chunk, then
+// flushes. The server calls it once the handler returns
+func (w *Writer) Finish() error {
+	var err error
+
+	switch {
+	case w.state == WriterStateHeaders:
+		err = w.writeBuffered(false)
+	case w.auto && w.chunked && w.state == WriterStateBody:
+		_, err = w.WriteChunkedBodyDone(false)
+	case w.encoding != nil && w.state == WriterStateBody:
+		err = w.endEncoding(false)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return w.flushBuffers()
+}
+
+// flushBuffers flushes the compressor, the writers Wrap added, then the
+// writer's own buffer
+func (w *Writer) flushBuffers() error {
+	if flusher, ok := w.encoding.(Flusher); ok && w.state == WriterStateBody {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := w.writer.(Flusher); ok && w.writer != w.buffer {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if w.buffer != nil {
+		return w.buffer.Flush()
+	}
+
+	return nil
+}
+
+// hasFraming reports whether the handler framed the body itself in Header()
+func (w *Writer) hasFraming() bool {
+	_, hasLength := w.header.Get("content-length")
+	_, hasEncoding := w.header.Get("transfer-encoding")
+
+	return hasLength || hasEncoding
 }
 
-func getStatusLine(statusCode StatusCode) []byte {
-	switch statusCode {
-	case StatusOk:
-		return []byte("HTTP/1.1 200 OK\r\n")
-	case StatusBadRequest:
-		return []byte("HTTP/1.1 400 Bad Request\r\n")
-	case StatusInternalServerError:
-		return []byte("HTTP/1.1 500 Internal Server Error\r\n")
+// writeBuffered writes Header() framed as chunked or with the length of the
+// buffered body, then the buffered body
+func (w *Writer) writeBuffered(chunked bool) error {
+	body := w.pending
+	w.pending = nil
+	w.auto = true
+
+	if _, exists := w.header.Get("content-type"); !exists && !w.hasNoBody() {
+		w.header.Set("Content-Type", "text/plain")
+	}
+
+	switch {
+	case w.hasNoBody():
+	case chunked:
+		w.header.Delete("Content-Length")
+		w.header.Replace("Transfer-Encoding", "chunked")
+	default:
+		encoded, err := w.encodeWhole(body)
+
+		if err != nil {
+			return err
+		}
+
+		body = encoded
+		w.header.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	if err := w.WriteHeaders(w.header); err != nil {
+		return err
+	}
+
+	if len(body) == 0 {
+		return nil
+	}
+
+	if w.chunked {
+		_, err := w.WriteChunkedBody(body)
+		return err
+	}
+
+	_, err := w.WriteBody(body)
+
+	return err
+}
+
+func (w *Writer) isComplete() bool {
+	switch {
+	case w.state == WriterStateStatusLine || w.state == WriterStateHeaders:
+		return false
+	case w.head:
+		return true
+	case w.chunked || w.encoding != nil:
+		return w.state == WriterStateDone
+	case w.contentLength >= 0:
+		return w.bodyWritten == w.contentLength
 	default:
-		return fmt.Appendf([]byte("HTTP/1.1"), " %d \r\n", statusCode)
+		return true
+	}
+}
+
+// checkState fails unless the writer is in one of the given states
+func (w *Writer) checkState(write string, states ...WriterState) error {
+	for _, state := range states {
+		if w.state == state {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: can't write %s in %s state", ErrorInvalidWriterState, write, w.state)
+}
+
+// writeDefaultHead writes whatever is missing of the status line and headers
+// before a body, defaulting to 200 and plain text
+func (w *Writer) writeDefaultHead(chunked bool) error {
+	if w.state == WriterStateStatusLine {
+		if err := w.WriteStatusLine(StatusOk); err != nil {
+			return err
+		}
+	}
+
+	if w.state == WriterStateHeaders {
+		heads := headers.NewHeaders()
+		heads.Set("Content-Type", "text/plain")
+
+		if chunked {
+			heads.Set("Transfer-Encoding", "chunked")
+		}
+
+		return w.WriteHeaders(heads)
 	}
+
+	return nil
+}
+
+func getStatusLine(statusCode StatusCode, reason string) []byte {
+	return fmt.Appendf(nil, "HTTP/1.1 %03d %s\r\n", statusCode, reason)
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	statusLine := getStatusLine(statusCode)
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes a status line with a custom reason phrase
+// instead of the registered one
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reason string) error {
+	if err := w.checkState("status line", WriterStateStatusLine); err != nil {
+		return err
+	}
+
+	if statusCode < 100 || statusCode > 999 {
+		return ErrorInvalidStatusCode
+	}
+
+	// a reason phrase allows the same characters as a field value, none
+	// that could end the status line early
+	if !headers.IsValidValue(reason) {
+		return ErrorInvalidReasonPhrase
+	}
+
+	w.statusCode = statusCode
+	w.state = WriterStateHeaders
+	statusLine := getStatusLine(statusCode, reason)
 
 	_, err := w.writer.Write(statusLine)
 
@@ -53,19 +391,88 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	headers := headers.NewHeaders()
 
 	headers.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	headers.Set("Connection", "close")
 	headers.Set("Content-Type", "text/plain")
 
 	return headers
 }
 
+// WriteHeaders writes nothing and returns the validation error if a field
+// name isn't a token or a value has control characters in it
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
+	if err := headers.Validate(); err != nil {
+		return err
+	}
+
+	if len(w.pending) > 0 {
+		return fmt.Errorf("%w: Write already buffered part of the body", ErrorInvalidWriterState)
+	}
+
+	if w.state == WriterStateStatusLine {
+		if err := w.WriteStatusLine(StatusOk); err != nil {
+			return err
+		}
+	}
+
+	if err := w.checkState("headers", WriterStateHeaders); err != nil {
+		return err
+	}
+
+	// the handler keeps writing the body the way its headers framed it even
+	// if it ends up compressed and chunked
+	w.chunked = headers.HasToken("transfer-encoding", "chunked")
+
+	if length, err := headers.GetInt("content-length"); err == nil && !w.chunked {
+		w.contentLength = int(length)
+	}
+
+	headers = w.startEncoding(headers)
+
+	if headers.HasToken("connection", "close") || !w.isSelfDelimiting(&headers) {
+		w.keepAlive = false
+	}
+
+	if w.hasNoBody() {
+		w.contentLength = 0
+		w.chunked = false
+	}
+
+	w.state = WriterStateBody
+
+	// informational responses are followed by the actual one, which frames
+	// its own body
+	if w.statusCode/100 == 1 && w.statusCode != 101 {
+		w.state = WriterStateStatusLine
+		w.contentLength = -1
+		w.chunked = false
+		w.bodyWritten = 0
+	}
+
+	// RFC 9110 section 8.6 forbids framing fields on 1xx and 204 responses
+	noFraming := w.statusCode/100 == 1 || w.statusCode == 204
 	buf := []byte{}
 
 	headers.ForEach(func(key, val string) {
-		buf = fmt.Appendf(buf, "%s: %s\r\n", key, val)
+		if key == "connection" && !w.keepAlive {
+			return
+		}
+		if key == "transfer-encoding" && (w.http10 || noFraming) {
+			return
+		}
+		if key == "content-length" && noFraming {
+			return
+		}
+		buf = fmt.Appendf(buf, "%s: %s\r\n", w.headerName(&headers, key), val)
 	})
 
+	_, hasConnection := headers.Get("connection")
+
+	if !w.keepAlive {
+		buf = fmt.Append(buf, "Connection: close\r\n")
+	} else if w.http10 && !hasConnection {
+		// persistence is opt-in for HTTP/1.0
+		buf = fmt.Append(buf, "Connection: keep-alive\r\n")
+	}
+
 	buf = fmt.Append(buf, "\r\n")
 
 	_, err := w.writer.Write(buf)
@@ -73,32 +480,155 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	return err
 }
 
+// hasNoBody reports whether the status forbids a body
+func (w *Writer) hasNoBody() bool {
+	return w.statusCode/100 == 1 || w.statusCode == 204 || w.statusCode == 304
+}
+
+// isSelfDelimiting reports whether the client can find the end of the body
+// without the connection being closed
+func (w *Writer) isSelfDelimiting(headers *headers.Headers) bool {
+	if w.hasNoBody() || w.head {
+		return true
+	}
+
+	if headers.HasToken("transfer-encoding", "chunked") {
+		return !w.http10
+	}
+
+	_, exists := headers.Get("content-length")
+
+	return exists
+}
+
+// WriteBody writes the status line and headers first if they weren't, in
+// which case the body is delimited by closing the connection
 func (w *Writer) WriteBody(body []byte) (int, error) {
-	return w.writer.Write(body)
+	if err := w.writeDefaultHead(false); err != nil {
+		return 0, err
+	}
+
+	if err := w.checkState("body", WriterStateBody); err != nil {
+		return 0, err
+	}
+
+	if w.chunked {
+		return 0, fmt.Errorf("%w: use WriteChunkedBody for a chunked body", ErrorInvalidWriterState)
+	}
+
+	if w.contentLength >= 0 && w.bodyWritten+len(body) > w.contentLength {
+		return 0, ErrorContentLengthExceeded
+	}
+
+	n, err := w.bodyWriter().Write(body)
+	w.bodyWritten += n
+
+	return n, err
 }
 
+// bodyWriter is where a body that isn't framed as chunks here goes
+func (w *Writer) bodyWriter() io.Writer {
+	switch {
+	case w.head:
+		return io.Discard
+	case w.encoding != nil:
+		return w.encoding
+	default:
+		return w.writer
+	}
+}
+
+// WriteChunkedBody writes the status line and chunked headers first if they
+// weren't
 func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
+	if err := w.writeDefaultHead(true); err != nil {
+		return 0, err
+	}
+
+	if err := w.checkState("chunk", WriterStateBody); err != nil {
+		return 0, err
+	}
+
+	if !w.chunked {
+		return 0, fmt.Errorf("%w: headers didn't set chunked transfer encoding", ErrorInvalidWriterState)
+	}
+
+	// an empty chunk would end the body
+	if len(body) == 0 {
+		return 0, nil
+	}
+
+	if w.head || w.encoding != nil || w.http10 {
+		n, err := w.bodyWriter().Write(body)
+		w.bodyWritten += n
+
+		return n, err
+	}
+
 	buf := []byte{}
 
 	buf = fmt.Appendf(buf, "%X\r\n", len(body))
 	buf = fmt.Append(buf, string(body), "\r\n")
+	w.bodyWritten += len(body)
 
 	return w.writer.Write(buf)
 }
 
 func (w *Writer) WriteChunkedBodyDone(hasTrailers bool) (int, error) {
+	if err := w.writeDefaultHead(true); err != nil {
+		return 0, err
+	}
+
+	if err := w.checkState("last chunk", WriterStateBody); err != nil {
+		return 0, err
+	}
+
+	if !w.chunked {
+		return 0, fmt.Errorf("%w: headers didn't set chunked transfer encoding", ErrorInvalidWriterState)
+	}
+
+	if w.encoding != nil {
+		return 0, w.endEncoding(hasTrailers)
+	}
+
+	if w.head || w.http10 {
+		w.state = WriterStateDone
+
+		if hasTrailers {
+			w.state = WriterStateTrailers
+		}
+
+		return 0, nil
+	}
+
 	if hasTrailers {
+		w.state = WriterStateTrailers
 		return w.writer.Write([]byte("0\r\n"))
 	} else {
+		w.state = WriterStateDone
 		return w.writer.Write([]byte("0\r\n\r\n"))
 	}
 }
 
 func (w *Writer) WriteTrailers(trailers headers.Headers) error {
+	if err := w.checkState("trailers", WriterStateTrailers); err != nil {
+		return err
+	}
+
+	if err := trailers.Validate(); err != nil {
+		return err
+	}
+
+	w.state = WriterStateDone
+
+	if w.head || w.http10 {
+		return nil
+	}
+
 	buf := []byte{}
 
 	trailers.ForEach(func(key, val string) {
-		buf = fmt.Appendf(buf, "%s: %s\r\n", key, val)
+		buf = fmt.Appendf(buf, "%s: %s\r\n", w.headerName(&trailers, key), val)
 	})
 
 	buf = fmt.Append(buf, "\r\n")
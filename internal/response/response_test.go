@@ -0,0 +1,511 @@
+package response
+
+import (
+	"bytes"
+	"http-server/internal/headers"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterOrder(t *testing.T) {
+	// Test: Status line, headers and body in order
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, w.Written())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Headers can't be written twice
+	err = w.WriteHeaders(GetDefaultHeaders(5))
+	assert.ErrorIs(t, err, ErrorInvalidWriterState)
+
+	// Test: Status line can't come after headers
+	err = w.WriteStatusLine(StatusBadRequest)
+	assert.ErrorIs(t, err, ErrorInvalidWriterState)
+
+	// Test: Body can't outgrow the content length
+	_, err = w.WriteBody([]byte("!"))
+	assert.ErrorIs(t, err, ErrorContentLengthExceeded)
+
+	// Test: Body written first gets a default status line and headers
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	assert.False(t, w.Written())
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nhello", buf.String())
+	assert.Equal(t, StatusOk, w.StatusCode())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Trailers only after the last chunk announced them
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	err = w.WriteTrailers(headers.NewHeaders())
+	assert.ErrorIs(t, err, ErrorInvalidWriterState)
+	assert.False(t, w.KeepAlive())
+
+	_, err = w.WriteChunkedBodyDone(true)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	assert.True(t, w.KeepAlive())
+
+	_, err = w.WriteChunkedBody([]byte("late"))
+	assert.ErrorIs(t, err, ErrorInvalidWriterState)
+
+	// Test: Incomplete body makes the connection unusable
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err = w.WriteBody([]byte("short"))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterAutoFraming(t *testing.T) {
+	// Test: Small body buffered and sent with its length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Header().Set("Content-Type", "text/html")
+	_, err := w.Write([]byte("<p>"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hi</p>"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.Equal(t, 9, w.BytesWritten())
+
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 9\r\n\r\n<p>hi</p>", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Body past the threshold switches to chunked
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	large := bytes.Repeat([]byte("a"), autoFramingThreshold+1)
+	_, err = w.Write(large)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("tail"))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n2001\r\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n4\r\ntail\r\n0\r\n\r\n"))
+	assert.True(t, w.KeepAlive())
+
+	// Test: Flush sends what's buffered and streams the rest chunked
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusAccepted))
+	_, err = w.Write([]byte("step 1"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 202 Accepted\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nstep 1\r\n", buf.String())
+	_, err = w.Write([]byte("step 2"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "6\r\nstep 2\r\n0\r\n\r\n"))
+
+	// Test: A length set in Header() is used as is
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.Header().Set("Content-Length", "5")
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", buf.String())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Write after WriteHeaders follows their framing
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	heads := headers.NewHeaders()
+	heads.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(heads))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nabc\r\n"))
+
+	// Test: Headers can't be written once Write buffered part of the body
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.WriteHeaders(GetDefaultHeaders(3)), ErrorInvalidWriterState)
+
+	// Test: No length or content type for a status without a body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+}
+
+// flushRecorder is a buffering layer added with Wrap that records flushes
+type flushRecorder struct {
+	pending []byte
+	out     io.Writer
+	flushes int
+}
+
+func (f *flushRecorder) Write(p []byte) (int, error) {
+	f.pending = append(f.pending, p...)
+	return len(p), nil
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushes++
+	_, err := f.out.Write(f.pending)
+	f.pending = nil
+	return err
+}
+
+func TestWriterBuffered(t *testing.T) {
+	var _ Flusher = (*Writer)(nil)
+
+	// Test: Nothing reaches the connection until Flush
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf, 1024)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: Finish flushes what's left
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(buf.String(), "hello"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "helloworld"))
+
+	// Test: Writes past the buffer size go through on their own
+	buf = &bytes.Buffer{}
+	w = NewBufferedWriter(buf, 16)
+	_, err = w.Write(bytes.Repeat([]byte("a"), autoFramingThreshold+1))
+	require.NoError(t, err)
+	assert.NotEmpty(t, buf.String())
+
+	// Test: Layers added with Wrap are flushed before the buffer
+	buf = &bytes.Buffer{}
+	w = NewBufferedWriter(buf, 1024)
+	var recorder *flushRecorder
+	w.Wrap(func(out io.Writer) io.Writer {
+		recorder = &flushRecorder{out: out}
+		return recorder
+	})
+	_, err = w.Write([]byte("wrapped"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, recorder.flushes)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nwrapped"))
+}
+
+func TestWriterHeaderOrder(t *testing.T) {
+	// Test: Fields go out in the order they were added, one line per value
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	heads := headers.NewHeaders()
+	heads.Add("Content-Length", "0")
+	heads.Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	heads.Add("Cache-Control", "no-store")
+	heads.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteHeaders(heads))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 0\r\n"+
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Cache-Control: no-store\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestWriterHeaderInjection(t *testing.T) {
+	// Test: A line break in a value fails without writing anything
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	heads := headers.NewHeaders()
+	heads.Add("Content-Length", "0")
+	heads.Add("Location", "/next\r\nSet-Cookie: admin=1")
+	err := w.WriteHeaders(heads)
+	assert.ErrorIs(t, err, headers.ErrorInvalidFieldValue)
+	assert.Empty(t, buf.String())
+	assert.False(t, w.Written())
+
+	// Test: The handler can still answer after fixing the headers
+	heads.Replace("Location", "/next")
+	require.NoError(t, w.WriteHeaders(heads))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nLocation: /next\r\n\r\n", buf.String())
+
+	// Test: Invalid name
+	w = NewWriter(&bytes.Buffer{})
+	heads = headers.NewHeaders()
+	heads.Add("X-Bad:Name", "x")
+	assert.ErrorIs(t, w.WriteHeaders(heads), headers.ErrorInvalidFieldName)
+
+	// Test: Trailers are checked too
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	_, err = w.WriteChunkedBodyDone(true)
+	require.NoError(t, err)
+	written := buf.Len()
+	trailers := headers.NewHeaders()
+	trailers.Add("X-Checksum", "abc\nX-Forged: 1")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrorInvalidFieldValue)
+	assert.Equal(t, written, buf.Len())
+}
+
+func TestWriterHeaderCase(t *testing.T) {
+	// Test: Names go out canonical whatever their spelling
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	heads := headers.NewHeaders()
+	heads.Add("content-length", "0")
+	heads.Add("X-REQUEST-ID", "abc")
+	heads.Add("etag", "\"v1\"")
+	require.NoError(t, w.WriteHeaders(heads))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nX-Request-Id: abc\r\nEtag: \"v1\"\r\n\r\n", buf.String())
+
+	// Test: Raw casing keeps names the way they were set
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseRawHeaderCase()
+	require.NoError(t, w.WriteHeaders(heads))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 0\r\nX-REQUEST-ID: abc\r\netag: \"v1\"\r\n\r\n", buf.String())
+}
+
+func TestWriterHttp10(t *testing.T) {
+	// Test: Chunked body is sent as is and delimited by closing the connection
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.UseHttp10()
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone(true)
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nhello world", buf.String())
+	assert.Equal(t, 11, w.BytesWritten())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Persistent connection is announced
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHttp10()
+	heads := headers.NewHeaders()
+	heads.Set("Content-Length", "2")
+	require.NoError(t, w.WriteHeaders(heads))
+	_, err = w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: keep-alive\r\n\r\nok", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+// upperCloser is a stand-in compressor that uppercases what goes through it
+type upperCloser struct {
+	w io.Writer
+}
+
+func (u upperCloser) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u upperCloser) Close() error {
+	_, err := io.WriteString(u.w, "!")
+	return err
+}
+
+func upperEncoder(minLength int) *ContentEncoder {
+	return &ContentEncoder{
+		Coding: "upper",
+		NewWriter: func(w io.Writer) io.WriteCloser {
+			return upperCloser{w}
+		},
+		Accept: func(heads *headers.Headers, length int) bool {
+			heads.Set("Vary", "Accept-Encoding")
+			return length < 0 || length >= minLength
+		},
+	}
+}
+
+func TestWriterEncoder(t *testing.T) {
+	// Test: Buffered body is encoded whole and gets the encoded length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetEncoder(upperEncoder(0))
+	_, err := io.WriteString(w, "hello")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nVary: Accept-Encoding\r\nContent-Encoding: upper\r\nContent-Length: 6\r\n\r\nHELLO!", buf.String())
+
+	// Test: Fixed length body is encoded into chunks, the handler still
+	// writing it against its own Content-Length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetEncoder(upperEncoder(0))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("!"))
+	assert.ErrorIs(t, err, ErrorContentLengthExceeded)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nVary: Accept-Encoding\r\nContent-Encoding: upper\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nHELLO\r\n1\r\n!\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Declined response keeps its framing and the headers Accept added
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetEncoder(upperEncoder(10))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\nVary: Accept-Encoding\r\n\r\nhello", buf.String())
+
+	// Test: HTTP/1.0 gets the encoded body close-delimited
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHttp10()
+	w.SetEncoder(upperEncoder(0))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone(false)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nVary: Accept-Encoding\r\nContent-Encoding: upper\r\nConnection: close\r\n\r\nHELLO!", buf.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterHead(t *testing.T) {
+	// Test: Headers go out as for GET, the body is dropped
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.UseHead()
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Handler may skip the body it declared
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHead()
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(100)))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Write sends the length of the body it buffered
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHead()
+	_, err = io.WriteString(w, "hello")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\n", buf.String())
+
+	// Test: Chunked body gets neither chunks nor trailers, the encoder still
+	// sets the headers a GET would get
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.UseHead()
+	w.SetEncoder(upperEncoder(0))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone(true)
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n"+
+		"Vary: Accept-Encoding\r\nContent-Encoding: upper\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterInformational(t *testing.T) {
+	// Test: 100 and 103 are followed by the final response, which frames
+	// its body on its own
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusContinue))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload")
+	hints.Set("Content-Length", "3")
+	require.NoError(t, w.WriteHeaders(hints))
+	require.NoError(t, w.WriteStatusLine(StatusOk))
+	heads := headers.NewHeaders()
+	heads.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteHeaders(heads))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nhello", buf.String())
+
+	// Test: Final response gets the length it declares, not the 1xx one
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusContinue))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, w.KeepAlive())
+
+	// Test: 204 goes out without framing fields
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	heads = GetDefaultHeaders(0)
+	heads.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(heads))
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered reason phrases
+	assert.Equal(t, "Not Found", StatusText(StatusNotFound))
+	assert.Equal(t, "HTTP Version Not Supported", StatusText(StatusHttpVersionNotSupported))
+	assert.Equal(t, "", StatusText(599))
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+
+	// Test: Unregistered code keeps the space before the empty reason
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(599))
+	assert.Equal(t, "HTTP/1.1 599 \r\n", buf.String())
+
+	// Test: Custom reason phrase
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLineWithReason(StatusOk, "All Good"))
+	assert.Equal(t, "HTTP/1.1 200 All Good\r\n", buf.String())
+
+	// Test: Reason phrase can't break the status line
+	w = NewWriter(&bytes.Buffer{})
+	err := w.WriteStatusLineWithReason(StatusOk, "OK\r\nX-Injected: 1")
+	assert.ErrorIs(t, err, ErrorInvalidReasonPhrase)
+	assert.False(t, w.Written())
+
+	// Test: Status code has to be three digits
+	err = w.WriteStatusLine(42)
+	assert.ErrorIs(t, err, ErrorInvalidStatusCode)
+}
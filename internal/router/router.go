@@ -0,0 +1,313 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type segmentKind int
+
+// ordered from least to most specific, a literal segment wins over a
+// parameter which wins over a wildcard
+const (
+	segmentWildcard segmentKind = iota
+	segmentParam
+	segmentLiteral
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to handlers registered by method and path
+// pattern. Patterns are made of literal segments, {name} segments matching
+// any single segment and an optional trailing *name segment matching the rest
+// of the path
+type Router struct {
+	routes []*route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers h for method and pattern, wrapped in middlewares. It
+// panics if the pattern is malformed or already registered for method
+func (r *Router) Handle(method string, pattern string, h server.Handler, middlewares ...server.Middleware) {
+	segments, err := parsePattern(pattern)
+
+	if err != nil {
+		panic(fmt.Sprintf("router: pattern %q: %v", pattern, err))
+	}
+
+	for _, existing := range r.routes {
+		if existing.method == method && sameSegments(existing.segments, segments) {
+			panic(fmt.Sprintf("router: %s %s conflicts with %s", method, pattern, existing.pattern))
+		}
+	}
+
+	r.routes = append(r.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: segments,
+		handler:  server.Chain(middlewares...)(h),
+	})
+}
+
+func (r *Router) Get(pattern string, h server.Handler, middlewares ...server.Middleware) {
+	r.Handle("GET", pattern, h, middlewares...)
+}
+
+func (r *Router) Post(pattern string, h server.Handler, middlewares ...server.Middleware) {
+	r.Handle("POST", pattern, h, middlewares...)
+}
+
+func (r *Router) Put(pattern string, h server.Handler, middlewares ...server.Middleware) {
+	r.Handle("PUT", pattern, h, middlewares...)
+}
+
+func (r *Router) Patch(pattern string, h server.Handler, middlewares ...server.Middleware) {
+	r.Handle("PATCH", pattern, h, middlewares...)
+}
+
+func (r *Router) Delete(pattern string, h server.Handler, middlewares ...server.Middleware) {
+	r.Handle("DELETE", pattern, h, middlewares...)
+}
+
+// Handler returns the router as a handler to pass to server.Serve
+func (r *Router) Handler() server.Handler {
+	return r.serve
+}
+
+func (r *Router) serve(w *response.Writer, req *request.Request) {
+	// OPTIONS * asks about the server as a whole rather than a resource
+	if req.Target.Form == request.TargetFormAsterisk {
+		r.serveOptions(w)
+		return
+	}
+
+	// authority form targets have no path to route on
+	if req.Target.Path == "" {
+		server.MakeStatusError(response.StatusNotFound).Write(w)
+		return
+	}
+
+	// the raw segments keep an encoded slash inside the segment it belongs to
+	parts := req.Target.RawSegments()
+	method := req.RequestLine.Method
+	best, bestParams := r.find(parts, method)
+
+	// HEAD is answered like GET, the writer drops the body
+	if best == nil && method == "HEAD" {
+		best, bestParams = r.find(parts, "GET")
+	}
+
+	if best == nil {
+		allowed := r.allowed(parts)
+
+		if len(allowed) == 0 {
+			server.MakeStatusError(response.StatusNotFound).Write(w)
+			return
+		}
+
+		server.MakeStatusError(response.StatusMethodNotAllowed).WithHeader("Allow", strings.Join(allowed, ", ")).Write(w)
+		return
+	}
+
+	req.Params = map[string]string{}
+	req.RawParams = bestParams
+
+	for name, raw := range bestParams {
+		req.Params[name] = decodeParam(raw)
+	}
+	best.handler(w, req)
+}
+
+// find returns the most specific route for method matching the path split in
+// parts, and the parameters it captured still percent-encoded
+func (r *Router) find(parts []string, method string) (*route, map[string]string) {
+	var best *route
+	var bestParams map[string]string
+
+	for _, route := range r.routes {
+		if route.method != method {
+			continue
+		}
+
+		params, ok := route.match(parts)
+
+		if ok && (best == nil || moreSpecific(route.segments, best.segments)) {
+			best = route
+			bestParams = params
+		}
+	}
+
+	return best, bestParams
+}
+
+// allowed lists, sorted, the methods of the routes matching the path split in
+// parts, HEAD included wherever GET is
+func (r *Router) allowed(parts []string) []string {
+	allowed := []string{}
+
+	for _, route := range r.routes {
+		if _, ok := route.match(parts); ok {
+			allowed = appendMethod(allowed, route.method)
+		}
+	}
+
+	slices.Sort(allowed)
+
+	return allowed
+}
+
+// appendMethod adds method to allowed unless it's there, with HEAD for GET
+func appendMethod(allowed []string, method string) []string {
+	if method == "GET" {
+		allowed = appendMethod(allowed, "HEAD")
+	}
+
+	if slices.Contains(allowed, method) {
+		return allowed
+	}
+
+	return append(allowed, method)
+}
+
+// serveOptions answers OPTIONS * with every method the router handles
+func (r *Router) serveOptions(w *response.Writer) {
+	allowed := []string{"OPTIONS"}
+
+	for _, route := range r.routes {
+		allowed = appendMethod(allowed, route.method)
+	}
+
+	slices.Sort(allowed)
+
+	heads := response.GetDefaultHeaders(0)
+	heads.Replace("Allow", strings.Join(allowed, ", "))
+
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(heads)
+}
+
+// match reports whether the percent-encoded segments in parts match the route
+// and returns the captured parameters as they are
+func (r *route) match(parts []string) (map[string]string, bool) {
+	params := map[string]string{}
+
+	for i, segment := range r.segments {
+		if segment.kind == segmentWildcard {
+			params[segment.value] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch segment.kind {
+		case segmentLiteral:
+			if decodeParam(parts[i]) != segment.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[segment.value] = parts[i]
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("must start with /")
+	}
+
+	parts := splitPath(pattern)
+	segments := make([]segment, 0, len(parts))
+
+	for i, part := range parts {
+		switch {
+		case strings.HasPrefix(part, "*"):
+			if i != len(parts)-1 {
+				return nil, errors.New("wildcard must be the last segment")
+			}
+			segments = append(segments, segment{kind: segmentWildcard, value: part[1:]})
+
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+
+			if name == "" {
+				return nil, errors.New("parameter must have a name")
+			}
+			segments = append(segments, segment{kind: segmentParam, value: name})
+
+		case strings.ContainsAny(part, "{}"):
+			return nil, errors.New("parameter must be a whole segment")
+
+		default:
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+
+	return segments, nil
+}
+
+// moreSpecific compares two matching routes segment by segment
+func moreSpecific(a []segment, b []segment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind != b[i].kind {
+			return a[i].kind > b[i].kind
+		}
+	}
+
+	return len(a) > len(b)
+}
+
+func sameSegments(a []segment, b []segment) bool {
+	return slices.EqualFunc(a, b, func(x segment, y segment) bool {
+		if x.kind != segmentLiteral {
+			return x.kind == y.kind
+		}
+		return x == y
+	})
+}
+
+// splitPath splits a path into its segments, "/" being a single empty one
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// decodeParam percent-decodes a captured path, the target was checked for
+// malformed escapes when it was parsed
+func decodeParam(raw string) string {
+	decoded, err := url.PathUnescape(raw)
+
+	if err != nil {
+		return raw
+	}
+
+	return decoded
+}
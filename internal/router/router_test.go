@@ -0,0 +1,180 @@
+package router
+
+import (
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"http-server/internal/servertest"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve runs a request through the router and parses what it wrote
+func serve(t *testing.T, r *Router, method string, target string) (*http.Response, string) {
+	return servertest.Serve(t, r.Handler(), method, target)
+}
+
+func reply(msg func(req *request.Request) string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		body := msg(req)
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := New()
+	r.Get("/", reply(func(req *request.Request) string { return "root" }))
+	r.Get("/users/{id}", reply(func(req *request.Request) string { return "user " + req.Param("id") }))
+	r.Get("/users/me", reply(func(req *request.Request) string { return "me" }))
+	r.Delete("/users/{id}", reply(func(req *request.Request) string { return "deleted " + req.Param("id") }))
+	r.Get("/static/*path", reply(func(req *request.Request) string { return "file " + req.Param("path") }))
+
+	// Test: Literal route
+	res, body := serve(t, r, "GET", "/")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "root", body)
+
+	// Test: Path parameter, query ignored
+	_, body = serve(t, r, "GET", "/users/42?fields=name")
+	assert.Equal(t, "user 42", body)
+
+	// Test: Literal segment wins over a parameter
+	_, body = serve(t, r, "GET", "/users/me")
+	assert.Equal(t, "me", body)
+
+	// Test: Same pattern, other method
+	_, body = serve(t, r, "DELETE", "/users/42")
+	assert.Equal(t, "deleted 42", body)
+
+	// Test: Wildcard captures the rest of the path
+	_, body = serve(t, r, "GET", "/static/css/site.css")
+	assert.Equal(t, "file css/site.css", body)
+
+	// Test: Unknown path
+	res, _ = serve(t, r, "GET", "/nope")
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Test: Parameter doesn't match an empty segment
+	res, _ = serve(t, r, "GET", "/users/")
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Test: Known path, wrong method
+	res, _ = serve(t, r, "POST", "/users/42")
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "DELETE, GET, HEAD", res.Header.Get("Allow"))
+
+	// Test: HEAD falls back to the GET route
+	res, body = serve(t, r, "HEAD", "/users/42")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "7", res.Header.Get("Content-Length"))
+
+	// Test: OPTIONS * lists every method the router handles
+	res, body = serve(t, r, "OPTIONS", "*")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", res.Header.Get("Allow"))
+	assert.Empty(t, body)
+
+	// Test: CONNECT has no path to route on
+	res, _ = serve(t, r, "CONNECT", "example.com:443")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestRouterHead(t *testing.T) {
+	// HEAD responses have no body, the route that answered is told by a field
+	route := func(name func(req *request.Request) string) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			body := name(req)
+			heads := response.GetDefaultHeaders(len(body))
+			heads.Set("X-Route", body)
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(heads)
+			w.WriteBody([]byte(body))
+		}
+	}
+
+	r := New()
+	r.Get("/page", route(func(req *request.Request) string { return "get" }))
+	r.Handle("HEAD", "/page", route(func(req *request.Request) string { return "head" }))
+	r.Get("/other/{id}", route(func(req *request.Request) string { return "get " + req.Param("id") }))
+	r.Post("/form", route(func(req *request.Request) string { return "post" }))
+
+	// Test: A HEAD route wins over the GET one
+	res, body := serve(t, r, "HEAD", "/page")
+	assert.Equal(t, "head", res.Header.Get("X-Route"))
+	assert.Empty(t, body)
+
+	_, body = serve(t, r, "GET", "/page")
+	assert.Equal(t, "get", body)
+
+	// Test: GET route answers HEAD, with its parameters
+	res, body = serve(t, r, "HEAD", "/other/7")
+	assert.Equal(t, "get 7", res.Header.Get("X-Route"))
+	assert.Equal(t, int64(len("get 7")), res.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: HEAD without a GET route isn't allowed
+	res, _ = serve(t, r, "HEAD", "/form")
+	assert.Equal(t, 405, res.StatusCode)
+	assert.Equal(t, "POST", res.Header.Get("Allow"))
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	// Test: Route middleware only wraps its own route
+	calls := 0
+	count := func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			calls++
+			next(w, req)
+		}
+	}
+
+	r := New()
+	r.Get("/counted", reply(func(req *request.Request) string { return "counted" }), count)
+	r.Get("/plain", reply(func(req *request.Request) string { return "plain" }))
+
+	_, body := serve(t, r, "GET", "/counted")
+	assert.Equal(t, "counted", body)
+	_, body = serve(t, r, "GET", "/plain")
+	assert.Equal(t, "plain", body)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRouterEncodedPaths(t *testing.T) {
+	r := New()
+	r.Get("/files/{name}", reply(func(req *request.Request) string { return req.Param("name") + " " + req.RawParam("name") }))
+	r.Get("/a b/*rest", reply(func(req *request.Request) string { return req.Param("rest") + " " + req.RawParam("rest") }))
+
+	// Test: An encoded slash stays inside its segment, the parameter decoded
+	_, body := serve(t, r, "GET", "/files/a%2Fb")
+	assert.Equal(t, "a/b a%2Fb", body)
+
+	// Test: Literal segments match their decoded form, wildcards keep the
+	// raw rest for forwarding
+	_, body = serve(t, r, "GET", "/a%20b/x%3Fy/z")
+	assert.Equal(t, "x?y/z x%3Fy/z", body)
+
+	// Test: Dot segments are resolved before matching
+	_, body = serve(t, r, "GET", "/a%20b/x/../files/c")
+	assert.Equal(t, "files/c files/c", body)
+
+	res, _ := serve(t, r, "GET", "/files/a/b")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestRouterPatterns(t *testing.T) {
+	// Test: Malformed patterns
+	assert.Panics(t, func() { New().Get("users", nil) })
+	assert.Panics(t, func() { New().Get("/static/*path/more", nil) })
+	assert.Panics(t, func() { New().Get("/users/{}", nil) })
+	assert.Panics(t, func() { New().Get("/users/id{id}", nil) })
+
+	// Test: Same route registered twice, whatever the parameter names
+	r := New()
+	r.Get("/users/{id}", nil)
+	assert.Panics(t, func() { r.Get("/users/{name}", nil) })
+	assert.NotPanics(t, func() { r.Post("/users/{name}", nil) })
+}
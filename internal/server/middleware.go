@@ -0,0 +1,15 @@
+package server
+
+// Middleware wraps a handler with behavior shared by many handlers
+type Middleware func(Handler) Handler
+
+// Chain composes middlewares into one, the first one being the outermost
+func Chain(middlewares ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+
+		return h
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBufferedResponse caps how much a response waiting for its turn may hold
+// in memory, past it the handler blocks until the earlier responses are out
+const maxBufferedResponse = 64 * 1024
+
+// sequencer makes the responses of pipelined requests go out on the connection
+// in the order the requests came in, whatever order their handlers finish in
+type sequencer struct {
+	conn         net.Conn
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	last         chan struct{}
+	inFlight     chan struct{}
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+	pending      int
+	idle         bool
+	closed       bool
+	timedOut     atomic.Bool
+}
+
+func newSequencer(conn net.Conn, maxInFlight int, idleTimeout time.Duration, writeTimeout time.Duration) *sequencer {
+	last := make(chan struct{})
+	close(last)
+
+	return &sequencer{
+		conn:         conn,
+		idleTimeout:  idleTimeout,
+		writeTimeout: writeTimeout,
+		last:         last,
+		inFlight:     make(chan struct{}, maxInFlight),
+	}
+}
+
+// next blocks until another request may be in flight and returns the slot its
+// response has to be written to
+func (q *sequencer) next() *responseSlot {
+	q.inFlight <- struct{}{}
+	q.wg.Add(1)
+
+	q.mu.Lock()
+	q.pending++
+	q.mu.Unlock()
+
+	slot := &responseSlot{
+		sequencer: q,
+		turn:      q.last,
+		done:      make(chan struct{}),
+	}
+	q.last = slot.done
+
+	return slot
+}
+
+// waitIdle is called before waiting for the next request, it starts the idle
+// timeout if no response is outstanding, otherwise it starts once the last one
+// is written
+func (q *sequencer) waitIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.idle = true
+
+	if q.pending == 0 {
+		q.setIdleDeadline()
+	} else {
+		q.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// stopIdle is called once the next request starts arriving, the caller sets
+// the deadline for reading it
+func (q *sequencer) stopIdle() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.idle = false
+}
+
+func (q *sequencer) setIdleDeadline() {
+	if q.idleTimeout > 0 {
+		q.conn.SetReadDeadline(time.Now().Add(q.idleTimeout))
+	} else {
+		q.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// closeIfIdle closes the connection if it's waiting for its next request with
+// no response outstanding, and reports whether it did
+func (q *sequencer) closeIfIdle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.idle || q.pending > 0 {
+		return false
+	}
+
+	q.closed = true
+	q.conn.Close()
+
+	return true
+}
+
+// close closes the connection whatever state it's in, responses still being
+// written are cut off
+func (q *sequencer) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.conn.Close()
+}
+
+// wait blocks until every handed out slot has been finished
+func (q *sequencer) wait() {
+	q.wg.Wait()
+}
+
+type responseSlot struct {
+	sequencer *sequencer
+	turn      chan struct{}
+	done      chan struct{}
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	active    bool
+}
+
+// Write goes straight to the connection once every earlier response has been
+// written and is buffered until then
+func (s *responseSlot) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		select {
+		case <-s.turn:
+		default:
+			if s.buf.Len()+len(p) <= maxBufferedResponse {
+				return s.buf.Write(p)
+			}
+			<-s.turn
+		}
+
+		if err := s.activate(); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.writeConn(p)
+}
+
+// activate flushes whatever was buffered while waiting for the turn, the
+// write timeout starts from here
+func (s *responseSlot) activate() error {
+	s.active = true
+
+	if s.sequencer.writeTimeout > 0 {
+		s.sequencer.conn.SetWriteDeadline(time.Now().Add(s.sequencer.writeTimeout))
+	}
+
+	if s.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.writeConn(s.buf.Bytes())
+	s.buf.Reset()
+
+	return err
+}
+
+func (s *responseSlot) writeConn(p []byte) (int, error) {
+	s.sequencer.mu.Lock()
+	closed := s.sequencer.closed
+	s.sequencer.mu.Unlock()
+
+	// an earlier response closed the connection, the client won't read this
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	n, err := s.sequencer.conn.Write(p)
+
+	if isTimeout(err) {
+		s.sequencer.timedOut.Store(true)
+	}
+
+	return n, err
+}
+
+// finish waits for the slot's turn, writes out anything still buffered and
+// hands the connection to the next response, closing it first unless
+// keepAlive is set
+func (s *responseSlot) finish(keepAlive bool) {
+	<-s.turn
+
+	s.mu.Lock()
+	if !s.active {
+		s.activate()
+	}
+	s.mu.Unlock()
+
+	q := s.sequencer
+
+	q.mu.Lock()
+	if !keepAlive && !q.closed {
+		q.closed = true
+		q.conn.Close()
+	}
+	q.pending--
+	if q.pending == 0 && q.idle {
+		q.setIdleDeadline()
+	}
+	q.mu.Unlock()
+
+	close(s.done)
+	<-q.inFlight
+	q.wg.Done()
+}
@@ -1,59 +1,258 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"http-server/internal/headers"
 	"http-server/internal/request"
 	"http-server/internal/response"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// HandlerError is an error response with a plain text message, handlers and
+// middleware use it to answer requests they can't serve
 type HandlerError struct {
 	Code    response.StatusCode
 	Message string
+	// fields are sent along with the default headers, in the order added
+	fields [][2]string
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// TimeoutHandler runs h with a request context that is cancelled after
+// timeout, for routes that shouldn't run longer than that
+func TimeoutHandler(h Handler, timeout time.Duration) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		h(w, req.WithContext(ctx))
+	}
+}
+
 type Server struct {
-	handler  Handler
-	listener net.Listener
-	isClosed atomic.Bool
+	handler              Handler
+	listener             net.Listener
+	isClosed             atomic.Bool
+	idleTimeout          time.Duration
+	maxRequestsPerConn   int
+	maxPipelinedRequests int
+	limits               request.Limits
+	readHeaderTimeout    time.Duration
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	timedOutConns        atomic.Int64
+	mu                   sync.Mutex
+	conns                map[*sequencer]struct{}
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	middlewares          []Middleware
+	rawHeaderCase        bool
+}
+
+type Option func(*Server)
+
+var errRequestTimeout = errors.New("request took too long to arrive")
+
+// writeBufferSize is how much of a response is collected before it is
+// written to the connection, handlers that stream call Flush
+const writeBufferSize = 4 * 1024
+
+// shutdownPollInterval is how often Shutdown looks for connections that went
+// idle and checks whether it's done
+const shutdownPollInterval = 10 * time.Millisecond
+
+const (
+	defaultIdleTimeout          = 60 * time.Second
+	defaultReadHeaderTimeout    = 10 * time.Second
+	defaultMaxRequestsPerConn   = 1000
+	defaultMaxPipelinedRequests = 16
+)
+
+// WithIdleTimeout sets how long a kept-alive connection may wait for its next
+// request before it is closed, zero means no limit
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
 }
 
-func newServer(h Handler, l net.Listener) *Server {
-	return &Server{
-		handler:  h,
-		listener: l,
-		isClosed: atomic.Bool{},
+// WithReadHeaderTimeout sets how long the request line and headers may take to
+// arrive once a request starts, 10 seconds by default so a client can't hold
+// a connection by trickling them. Zero means the read timeout applies
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
 	}
 }
 
-func Serve(port uint16, h Handler) (*Server, error) {
+// WithReadTimeout sets how long a whole request, body included, may take to
+// arrive once it starts, zero means no limit
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout sets how long writing a response may take once the earlier
+// responses on the connection are out, zero means no limit
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithMaxRequestsPerConn sets how many requests are served on one connection
+// before it is closed, zero means no limit
+func WithMaxRequestsPerConn(n int) Option {
+	return func(s *Server) {
+		s.maxRequestsPerConn = n
+	}
+}
+
+// WithMaxPipelinedRequests sets how many requests of one connection may be
+// handled at the same time before the server stops reading ahead
+func WithMaxPipelinedRequests(n int) Option {
+	return func(s *Server) {
+		s.maxPipelinedRequests = max(n, 1)
+	}
+}
+
+// WithLimits bounds the size of the requests the server accepts, requests
+// over them are answered with 414, 431 or 413
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithMiddleware wraps the handler with middlewares for every request, the
+// first one being the outermost
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(s *Server) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
+
+// WithRawHeaderCase writes response header names spelled the way handlers set
+// them, for clients that depend on a particular casing
+func WithRawHeaderCase() Option {
+	return func(s *Server) {
+		s.rawHeaderCase = true
+	}
+}
+
+func newServer(h Handler, l net.Listener, opts ...Option) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	server := &Server{
+		ctx:                  ctx,
+		cancel:               cancel,
+		handler:              h,
+		listener:             l,
+		isClosed:             atomic.Bool{},
+		idleTimeout:          defaultIdleTimeout,
+		readHeaderTimeout:    defaultReadHeaderTimeout,
+		maxRequestsPerConn:   defaultMaxRequestsPerConn,
+		maxPipelinedRequests: defaultMaxPipelinedRequests,
+		limits:               request.DefaultLimits,
+		conns:                make(map[*sequencer]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	server.handler = Chain(server.middlewares...)(h)
+
+	return server
+}
+
+func Serve(port uint16, h Handler, opts ...Option) (*Server, error) {
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 
 	if err != nil {
 		return nil, err
 	}
 
-	server := newServer(h, l)
+	server := newServer(h, l, opts...)
 
 	go server.listen()
 
 	return server, nil
 }
 
+// Close stops accepting connections, cancels the requests' contexts and
+// closes the open connections right away, use Shutdown to let in-flight
+// requests finish
 func (s *Server) Close() error {
+	s.isClosed.Store(true)
 	err := s.listener.Close()
+	s.cancel()
 
-	if err != nil {
-		return err
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.close()
 	}
+	s.mu.Unlock()
 
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for the
+// active ones to finish their requests. If ctx ends first the remaining
+// connections are closed and ctx's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
 	s.isClosed.Store(true)
-	return nil
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections waiting for a next request and reports
+// whether none are left
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.closeIfIdle()
+	}
+
+	return len(s.conns) == 0
+}
+
+// trackConn adds or removes a connection from the ones Shutdown waits for
+func (s *Server) trackConn(conn *sequencer, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
 }
 
 func (s *Server) listen() {
@@ -73,18 +272,205 @@ func (s *Server) listen() {
 }
 
 func (s *Server) handle(conn net.Conn) {
+	reader := request.NewLimitedReader(conn, s.limits)
+	responses := newSequencer(conn, s.maxPipelinedRequests, s.idleTimeout, s.writeTimeout)
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.trackConn(responses, true)
+	defer s.trackConn(responses, false)
 	defer conn.Close()
+	defer s.countTimeout(responses)
+	// handlers still running keep their context until their response is out
+	defer cancel()
+	defer responses.wait()
+
+	// accepted while Close or Shutdown went through the connections
+	if s.isClosed.Load() {
+		return
+	}
 
-	request, err := request.RequestFromReader(conn)
+	for served := 1; ; served++ {
+		reader.Wait()
+		responses.waitIdle()
+		err := reader.Peek()
+		responses.stopIdle()
 
-	if err != nil {
-		handlerError := MakeHandlerError(response.StatusBadRequest, err.Error())
-		handlerError.write(conn)
+		// the client hung up or stayed idle for too long, nobody to answer
+		if err != nil {
+			if isConnectionGone(err) {
+				cancel()
+			}
+			return
+		}
+
+		start := time.Now()
+		conn.SetReadDeadline(s.readHeaderDeadline(start))
+
+		request, err := reader.ReadRequest()
+
+		if err != nil {
+			if isTimeout(err) {
+				responses.timedOut.Store(true)
+				err = errRequestTimeout
+			}
+			if !isConnectionGone(err) {
+				slot := responses.next()
+				responseWriter := response.NewBufferedWriter(slot, writeBufferSize)
+				responseWriter.DisableKeepAlive()
+				MakeHandlerError(statusForError(err), err.Error()).Write(responseWriter)
+				responseWriter.Finish()
+				slot.finish(false)
+			}
+			return
+		}
+
+		conn.SetReadDeadline(s.readDeadline(start))
+
+		slot := responses.next()
+		responseWriter := response.NewBufferedWriter(slot, writeBufferSize)
+		keepAlive := request.KeepAlive() && !s.isClosed.Load() && !s.isLastRequest(served)
+
+		if !keepAlive {
+			responseWriter.DisableKeepAlive()
+		}
+
+		if request.RequestLine.HttpVersion == "HTTP/1.0" {
+			responseWriter.UseHttp10()
+		}
+
+		if request.RequestLine.Method == "HEAD" {
+			responseWriter.UseHead()
+		}
+
+		if s.rawHeaderCase {
+			responseWriter.UseRawHeaderCase()
+		}
+
+		requestCtx, cancelRequest := context.WithCancel(ctx)
+		request = request.WithContext(requestCtx)
+
+		// later requests are read and handled while this one runs once its
+		// body is consumed, the sequencer holds their responses back until
+		// this one is written
+		go func() {
+			s.handler(responseWriter, request)
+			cancelRequest()
+			bodyErr := request.Body.Close()
+
+			if isTimeout(bodyErr) {
+				responses.timedOut.Store(true)
+			}
+
+			if !responseWriter.Written() {
+				writeFallback(responseWriter, bodyErr)
+			}
+
+			responseWriter.Finish()
+
+			slot.finish(responseWriter.KeepAlive() && bodyErr == nil)
+		}()
+
+		if !keepAlive {
+			// nothing more is read, but the client hanging up still has to
+			// cancel the requests in flight. Anything it sends is ignored
+			if err := reader.Peek(); isConnectionGone(err) {
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// readHeaderDeadline is when reading a request's line and headers that started
+// arriving at start times out
+func (s *Server) readHeaderDeadline(start time.Time) time.Time {
+	timeout := s.readHeaderTimeout
+
+	if timeout == 0 || (s.readTimeout > 0 && s.readTimeout < timeout) {
+		timeout = s.readTimeout
+	}
+
+	if timeout == 0 {
+		return time.Time{}
+	}
+
+	return start.Add(timeout)
+}
+
+// readDeadline is when reading a whole request that started arriving at start,
+// body included, times out
+func (s *Server) readDeadline(start time.Time) time.Time {
+	if s.readTimeout == 0 {
+		return time.Time{}
+	}
+
+	return start.Add(s.readTimeout)
+}
+
+func (s *Server) countTimeout(responses *sequencer) {
+	if responses.timedOut.Load() {
+		s.timedOutConns.Add(1)
+	}
+}
+
+// TimedOutConnections returns how many connections were closed because reading
+// a request or writing a response took too long
+func (s *Server) TimedOutConnections() int64 {
+	return s.timedOutConns.Load()
+}
+
+// statusForError picks the response to a request that couldn't be parsed
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrorRequestLineTooLong):
+		return response.StatusUriTooLong
+	case errors.Is(err, headers.ErrorHeadersTooLarge), errors.Is(err, headers.ErrorTooManyHeaders):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrorBodyTooLarge):
+		return response.StatusContentTooLarge
+	case errors.Is(err, errRequestTimeout):
+		return response.StatusRequestTimeout
+	case errors.Is(err, request.ErrorHttpVersionNotSupported):
+		return response.StatusHttpVersionNotSupported
+	case errors.Is(err, request.ErrorUnsupportedTransferCoding):
+		return response.StatusNotImplemented
+	default:
+		return response.StatusBadRequest
+	}
+}
+
+func (s *Server) isLastRequest(served int) bool {
+	return s.maxRequestsPerConn > 0 && served >= s.maxRequestsPerConn
+}
+
+// isConnectionGone reports whether a read error means there is nobody left to
+// answer because the client hung up
+func isConnectionGone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeFallback answers a request whose handler returned without writing
+// anything, blaming the body if reading it failed
+func writeFallback(w *response.Writer, bodyErr error) {
+	if bodyErr != nil {
+		// what's left of the body can't be read, the connection is closed
+		w.DisableKeepAlive()
+
+		if isTimeout(bodyErr) {
+			bodyErr = errRequestTimeout
+		}
+
+		MakeHandlerError(statusForError(bodyErr), bodyErr.Error()).Write(w)
 		return
 	}
 
-	responseWriter := response.NewWriter(conn)
-	s.handler(responseWriter, request)
+	MakeHandlerError(response.StatusInternalServerError, "handler didn't write a response").Write(w)
 }
 
 func MakeHandlerError(code response.StatusCode, msg string) *HandlerError {
@@ -94,11 +480,27 @@ func MakeHandlerError(code response.StatusCode, msg string) *HandlerError {
 	}
 }
 
-func (h *HandlerError) write(w io.Writer) {
-	responseWriter := response.NewWriter(w)
+// MakeStatusError is a HandlerError with the reason phrase of code as message
+func MakeStatusError(code response.StatusCode) *HandlerError {
+	return MakeHandlerError(code, response.StatusText(code))
+}
+
+// WithHeader adds a field to send with the error, such as Allow with a 405
+func (h *HandlerError) WithHeader(key string, value string) *HandlerError {
+	h.fields = append(h.fields, [2]string{key, value})
+
+	return h
+}
 
-	responseWriter.WriteStatusLine(h.Code)
+// Write answers with the error
+func (h *HandlerError) Write(w *response.Writer) {
+	w.WriteStatusLine(h.Code)
 	headers := response.GetDefaultHeaders(len(h.Message))
-	responseWriter.WriteHeaders(headers)
-	responseWriter.WriteBody([]byte(h.Message))
+
+	for _, field := range h.fields {
+		headers.Replace(field[0], field[1])
+	}
+
+	w.WriteHeaders(headers)
+	w.WriteBody([]byte(h.Message))
 }
@@ -0,0 +1,657 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"http-server/internal/headers"
+	"http-server/internal/request"
+	"http-server/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs h on a random loopback port and returns a connection to it
+func startServer(t *testing.T, h Handler, opts ...Option) (*Server, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := newServer(h, l, opts...)
+	go server.listen()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return server, conn
+}
+
+func echoTarget(w *response.Writer, req *request.Request) {
+	msg := req.RequestLine.RequestTarget
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+	w.WriteBody([]byte(msg))
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return res, string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: Several requests on one connection, the last one closing it
+	_, conn := startServer(t, echoTarget)
+	reader := bufio.NewReader(conn)
+
+	for _, target := range []string{"/one", "/two"} {
+		_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+
+		res, body := readResponse(t, reader)
+		assert.Equal(t, target, body)
+		assert.False(t, res.Close)
+	}
+
+	_, err := io.WriteString(conn, "GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body := readResponse(t, reader)
+	assert.Equal(t, "/three", body)
+	assert.True(t, res.Close)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection closed after the maximum number of requests
+	_, conn = startServer(t, echoTarget, WithMaxRequestsPerConn(1))
+	reader = bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "GET /only HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ = readResponse(t, reader)
+	assert.True(t, res.Close)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHttp10(t *testing.T) {
+	// Test: Connection closed after the response unless kept alive
+	_, conn := startServer(t, echoTarget)
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "GET /one HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body := readResponse(t, reader)
+	assert.Equal(t, "/one", body)
+	assert.Equal(t, "keep-alive", res.Header.Get("Connection"))
+
+	_, err = io.WriteString(conn, "GET /two HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body = readResponse(t, reader)
+	assert.Equal(t, "/two", body)
+	assert.True(t, res.Close)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Chunked response is close-delimited for HTTP/1.0
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteChunkedBody([]byte("streamed"))
+		w.WriteChunkedBodyDone(false)
+	})
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.NotContains(t, strings.ToLower(string(raw)), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\nstreamed"))
+
+	// Test: Later HTTP/1.x versions are answered as HTTP/1.1
+	_, conn = startServer(t, echoTarget)
+	reader = bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "GET /minor HTTP/1.2\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body = readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "/minor", body)
+	assert.False(t, res.Close)
+
+	// Test: Other major versions are answered with 505
+	_, err = io.WriteString(conn, "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 505, res.StatusCode)
+	assert.True(t, res.Close)
+}
+
+func TestRawHeaderCase(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		heads := headers.NewHeaders()
+		heads.Add("content-length", "0")
+		heads.Add("X-LEGACY-Flag", "1")
+		w.WriteHeaders(heads)
+	}
+
+	// Test: Canonical names by default
+	_, conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "\r\nContent-Length: 0\r\nX-Legacy-Flag: 1\r\n")
+
+	// Test: Names as set by the handler
+	_, conn = startServer(t, handler, WithRawHeaderCase())
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	raw, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "\r\ncontent-length: 0\r\nX-LEGACY-Flag: 1\r\n")
+}
+
+func TestPipelining(t *testing.T) {
+	// Test: Responses come back in request order even if later handlers finish first
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		echoTarget(w, req)
+	})
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn,
+		"GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+			"POST /fast HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"+
+			"GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	for _, target := range []string{"/slow", "/fast", "/last"} {
+		_, body := readResponse(t, reader)
+		assert.Equal(t, target, body)
+	}
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Nothing is written after a response that closes the connection
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/close" {
+			w.DisableKeepAlive()
+		}
+		echoTarget(w, req)
+	})
+	reader = bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn,
+		"GET /close HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+			"GET /dropped HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body := readResponse(t, reader)
+	assert.Equal(t, "/close", body)
+	assert.True(t, res.Close)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestLimits(t *testing.T) {
+	limits := request.Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxBodyBytes:        8,
+	}
+
+	tests := []struct {
+		name   string
+		data   string
+		status int
+	}{
+		{"request line", "GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n", 414},
+		{"headers", "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n", 431},
+		{"body", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\n123456789", 413},
+	}
+
+	for _, tt := range tests {
+		// Test: Requests over the limits get the matching status
+		_, conn := startServer(t, echoTarget, WithLimits(limits))
+
+		_, err := io.WriteString(conn, tt.data)
+		require.NoError(t, err, tt.name)
+
+		res, _ := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, tt.status, res.StatusCode, tt.name)
+		assert.True(t, res.Close, tt.name)
+	}
+}
+
+func TestSmuggling(t *testing.T) {
+	// Test: CL.TE request is refused and what it hides is never served
+	served := make(chan string, 2)
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		served <- req.Target.Path
+		echoTarget(w, req)
+	})
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Length: 35\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"0\r\n\r\nGET /admin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ := readResponse(t, reader)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.True(t, res.Close)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Empty(t, served)
+
+	// Test: Unknown transfer coding is not implemented
+	_, conn = startServer(t, echoTarget)
+	reader = bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 501, res.StatusCode)
+
+	// Test: Two Host fields get a 400
+	_, conn = startServer(t, echoTarget)
+	reader = bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nHost: evil.example\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.True(t, res.Close)
+}
+
+func TestTimeouts(t *testing.T) {
+	// Test: Request line and headers that don't arrive in time get a 408
+	server, conn := startServer(t, echoTarget, WithReadHeaderTimeout(50*time.Millisecond))
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: local")
+	require.NoError(t, err)
+
+	res, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, res.StatusCode)
+	assert.True(t, res.Close)
+	assert.Eventually(t, func() bool {
+		return server.TimedOutConnections() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Request heads have a deadline by default
+	server, _ = startServer(t, echoTarget)
+	assert.Equal(t, defaultReadHeaderTimeout, server.readHeaderTimeout)
+
+	// Test: A body that doesn't arrive in time gets a 408 and the connection
+	// is closed
+	server, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		req.ReadBody()
+	}, WithReadTimeout(50*time.Millisecond))
+
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+	require.NoError(t, err)
+
+	res, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, 408, res.StatusCode)
+	assert.True(t, res.Close)
+	assert.Eventually(t, func() bool {
+		return server.TimedOutConnections() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: A client that doesn't read its response is cut off
+	written := make(chan error, 1)
+	server, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		body := bytes.Repeat([]byte("x"), 64*1024*1024)
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, err := w.WriteBody(body)
+		written <- err
+	}, WithWriteTimeout(50*time.Millisecond))
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	select {
+	case err = <-written:
+		assert.True(t, isTimeout(err), err)
+	case <-time.After(time.Second):
+		t.Fatal("write didn't time out")
+	}
+
+	assert.Eventually(t, func() bool {
+		return server.TimedOutConnections() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Idle connections are closed without a response
+	server, conn = startServer(t, echoTarget, WithIdleTimeout(50*time.Millisecond))
+	reader := bufio.NewReader(conn)
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, reader)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, int64(0), server.TimedOutConnections())
+
+	// Test: Idle timeout doesn't cut off a slow handler
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(100 * time.Millisecond)
+		echoTarget(w, req)
+	}, WithIdleTimeout(50*time.Millisecond))
+
+	_, err = io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/slow", body)
+}
+
+func TestShutdown(t *testing.T) {
+	// Test: In-flight requests finish, idle connections are closed
+	started := make(chan struct{})
+	server, busy := startServer(t, func(w *response.Writer, req *request.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		echoTarget(w, req)
+	})
+
+	idle, err := net.Dial("tcp", server.listener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	_, err = io.WriteString(busy, "GET /busy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	err = server.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(busy)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "/busy", body)
+
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections still active at the deadline are closed
+	started = make(chan struct{})
+	server, busy = startServer(t, func(w *response.Writer, req *request.Request) {
+		close(started)
+		time.Sleep(time.Second)
+	})
+
+	_, err = io.WriteString(busy, "GET /stuck HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = busy.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Context is cancelled when the client hangs up
+	cancelled := make(chan struct{})
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	})
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	conn.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context wasn't cancelled on disconnect")
+	}
+
+	// Test: Context is cancelled when the route's deadline passes
+	var ctxErr error
+	_, conn = startServer(t, TimeoutHandler(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		ctxErr = req.Context().Err()
+		echoTarget(w, req)
+	}, 20*time.Millisecond))
+
+	_, err = io.WriteString(conn, "GET /deadline HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/deadline", body)
+	assert.ErrorIs(t, ctxErr, context.DeadlineExceeded)
+
+	// Test: Context is cancelled when the server is closed
+	cancelled = make(chan struct{})
+	server, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	})
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	server.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context wasn't cancelled on close")
+	}
+}
+
+func TestRequestContextPipelined(t *testing.T) {
+	// Test: Bytes after a Connection: close request don't cancel its context
+	var ctxErr error
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(20 * time.Millisecond)
+		ctxErr = req.Context().Err()
+		echoTarget(w, req)
+	})
+
+	_, err := io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/a", body)
+	assert.True(t, res.Close)
+	assert.NoError(t, ctxErr)
+
+	// Test: A malformed request behind a running one doesn't cancel it
+	_, conn = startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(20 * time.Millisecond)
+		ctxErr = req.Context().Err()
+		echoTarget(w, req)
+	})
+
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nnot a request\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "/a", body)
+	assert.NoError(t, ctxErr)
+
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 400, res.StatusCode)
+}
+
+func TestHandlerWritesNothing(t *testing.T) {
+	// Test: A handler that writes nothing gets a 500 and the connection stays usable
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/ok" {
+			echoTarget(w, req)
+		}
+	})
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "GET /nothing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, _ := readResponse(t, reader)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.False(t, res.Close)
+
+	_, err = io.WriteString(conn, "GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "/ok", body)
+}
+
+func TestAutoFraming(t *testing.T) {
+	// Test: Handler only calls Write, the server finishes the response
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<p>")
+		io.WriteString(w, req.Target.Path)
+		io.WriteString(w, "</p>")
+	})
+	reader := bufio.NewReader(conn)
+
+	for _, target := range []string{"/one", "/two"} {
+		_, err := io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+
+		res, body := readResponse(t, reader)
+		assert.Equal(t, "<p>"+target+"</p>", body)
+		assert.Equal(t, int64(len(body)), res.ContentLength)
+		assert.Equal(t, "text/html", res.Header.Get("Content-Type"))
+		assert.False(t, res.Close)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	// Test: Flushed part of a streamed response arrives while the handler runs
+	release := make(chan struct{})
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "first")
+		w.Flush()
+		<-release
+		io.WriteString(w, "second")
+	})
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+
+	first := make([]byte, len("first"))
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(first))
+
+	close(release)
+	rest, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+}
+
+func TestHead(t *testing.T) {
+	// Test: HEAD response has the GET headers and no body, the connection
+	// staying usable
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<p>hello</p>")
+	})
+	reader := bufio.NewReader(conn)
+
+	_, err := io.WriteString(conn, "HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), res.ContentLength)
+	assert.Equal(t, "text/html", res.Header.Get("Content-Type"))
+	assert.False(t, res.Close)
+
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "<p>hello</p>", body)
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: Middlewares run outermost first and can observe the response
+	order := []string{}
+	var status response.StatusCode
+	var written int
+	var wire bytes.Buffer
+	done := make(chan struct{})
+
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name)
+				next(w, req)
+			}
+		}
+	}
+
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.Wrap(func(dst io.Writer) io.Writer {
+				return io.MultiWriter(dst, &wire)
+			})
+			next(w, req)
+			status = w.StatusCode()
+			written = w.BytesWritten()
+			close(done)
+		}
+	}
+
+	_, conn := startServer(t, echoTarget, WithMiddleware(observe, Chain(tag("a"), tag("b"))))
+
+	_, err := io.WriteString(conn, "GET /observed HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	<-done
+
+	assert.Equal(t, []string{"a", "b"}, order)
+	assert.Equal(t, response.StatusOk, status)
+	assert.Equal(t, len("/observed"), written)
+	assert.True(t, strings.HasPrefix(wire.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(wire.String(), "\r\n\r\n/observed"))
+}
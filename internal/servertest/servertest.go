@@ -0,0 +1,51 @@
+// Package servertest runs handlers on requests built in tests, the way the
+// server would but without a connection
+package servertest
+
+import (
+	"bufio"
+	"bytes"
+	"http-server/internal/request"
+	"http-server/internal/response"
+	"http-server/internal/server"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Serve runs h on a method request for target carrying the given field
+// lines, such as "Accept-Encoding: gzip", and returns the response it wrote
+// along with its body. Like the server, it drops the body of a HEAD response
+// and calls Finish once h returns
+func Serve(t *testing.T, h server.Handler, method string, target string, fields ...string) (*http.Response, string) {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+
+	for _, field := range fields {
+		raw += field + "\r\n"
+	}
+
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	output := &bytes.Buffer{}
+	w := response.NewWriter(output)
+
+	if method == "HEAD" {
+		w.UseHead()
+	}
+
+	h(w, req)
+	require.NoError(t, w.Finish())
+
+	res, err := http.ReadResponse(bufio.NewReader(output), &http.Request{Method: method})
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return res, string(body)
+}